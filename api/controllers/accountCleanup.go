@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Returned from the purge transaction to roll back a dry run
+var errPurgeDryRun = errors.New("dry run")
+
+// PurgeReport lists everything purging a user removes or changes
+type PurgeReport struct {
+	UserID             uint             `json:"userId"`
+	Name               string           `json:"name"`
+	DryRun             bool             `json:"dryRun"`
+	DeletedRows        map[string]int64 `json:"deletedRows"`        // Rows per table
+	ReassignedSessions map[uint]uint    `json:"reassignedSessions"` // Session ID to new host ID
+	DeletedSessions    []uint           `json:"deletedSessions"`    // Hosted sessions nobody else attended
+	Media              []string         `json:"media"`              // Files and directories under uploads
+}
+
+// Grace period between deactivation and purge
+func purgeGracePeriod() time.Duration {
+	return time.Duration(viper.GetInt("users.purgeGraceDays")) * 24 * time.Hour
+}
+
+// Blocks a user from signing in and hides their profile, keeping their data until the purge
+func deactivateUser(user *models.User, reason string) error {
+	if err := RevokeAllUserTokens(user.ID, reason); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		// Leave any meeting the user is still in
+		if err := tx.Model(&models.UserSession{}).Where("user_id = ? AND left_at IS NULL", user.ID).Update("left_at", uint(now.Unix())).Error; err != nil {
+			return err
+		}
+		// gorm's soft delete sets DeletedAt, which hides the user from every normal query
+		return tx.Delete(user).Error
+	})
+}
+
+// Removes a user and everything that belongs to them, reassigning what other users still need
+func purgeUser(user models.User, dryRun bool) (*PurgeReport, error) {
+	report := &PurgeReport{
+		UserID:             user.ID,
+		Name:               user.Name,
+		DryRun:             dryRun,
+		DeletedRows:        map[string]int64{},
+		ReassignedSessions: map[uint]uint{},
+	}
+
+	err := inits.DB.Transaction(func(tx *gorm.DB) error {
+		// Recordings of every meeting the user attended
+		var attended []uint
+		if err := tx.Unscoped().Model(&models.UserSession{}).Where("user_id = ?", user.ID).Distinct().Pluck("session_id", &attended).Error; err != nil {
+			return err
+		}
+		deletedSessions := map[uint]bool{}
+
+		// Hosted sessions go to the first other participant, or away if there was none
+		var hosted []models.Session
+		if err := tx.Unscoped().Where("host_id = ?", user.ID).Find(&hosted).Error; err != nil {
+			return err
+		}
+		for _, session := range hosted {
+			var next models.UserSession
+			err := tx.Unscoped().Where("session_id = ? AND user_id != ?", session.ID, user.ID).
+				Order("joined_at, id").First(&next).Error
+			if err == nil {
+				if err := tx.Unscoped().Model(&models.Session{}).Where("id = ?", session.ID).Update("host_id", next.UserID).Error; err != nil {
+					return err
+				}
+				report.ReassignedSessions[session.ID] = next.UserID
+				continue
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err := tx.Unscoped().Where("session_id = ?", session.ID).Delete(&models.UserSession{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("session_id = ?", session.ID).Delete(&models.SessionInvitation{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("session_id = ?", session.ID).Delete(&models.SessionCoHost{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("session_id = ?", session.ID).Delete(&models.WaitingRoomEntry{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("session_id = ?", session.ID).Delete(&models.SessionBan{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&models.Session{}, session.ID).Error; err != nil {
+				return err
+			}
+			deletedSessions[session.ID] = true
+			report.DeletedSessions = append(report.DeletedSessions, session.ID)
+			report.Media = append(report.Media, filepath.Join("./uploads", fmt.Sprint(session.ID)))
+		}
+		report.DeletedRows["sessions"] = int64(len(report.DeletedSessions))
+
+		for _, sessionID := range attended {
+			if deletedSessions[sessionID] {
+				continue
+			}
+			report.Media = append(report.Media,
+				filepath.Join("./uploads", fmt.Sprint(sessionID), fmt.Sprint(user.ID)),
+				filepath.Join("./uploads", fmt.Sprint(sessionID), "vod", fmt.Sprintf("%d.mp4", user.ID)))
+		}
+		if user.AvatarKey != "" {
+			for _, size := range avatarSizes {
+				report.Media = append(report.Media, avatarFile(user.AvatarKey, size))
+			}
+		}
+		var exportFiles []string
+		if err := tx.Model(&models.DataExport{}).Where("user_id = ? AND file_path <> ''", user.ID).Pluck("file_path", &exportFiles).Error; err != nil {
+			return err
+		}
+		report.Media = append(report.Media, exportFiles...)
+
+		// Revoked access tokens stay until they expire, so a token issued before the purge keeps failing
+		deletes := []struct {
+			table string
+			model interface{}
+			query string
+			args  []interface{}
+		}{
+			{"friends", &models.Friend{}, "user_id = ? OR friend_id = ?", []interface{}{user.ID, user.ID}},
+			{"blocks", &models.Block{}, "user_id = ? OR blocked_id = ?", []interface{}{user.ID, user.ID}},
+			{"notifications", &models.Notification{}, "user_id = ? OR actor_id = ?", []interface{}{user.ID, user.ID}},
+			{"contact_group_members", &models.ContactGroupMember{}, "friend_id = ? OR group_id IN (SELECT id FROM contact_groups WHERE user_id = ?)", []interface{}{user.ID, user.ID}},
+			{"contact_groups", &models.ContactGroup{}, "user_id = ?", []interface{}{user.ID}},
+			{"favorites", &models.Favorite{}, "user_id = ? OR favorite_id = ?", []interface{}{user.ID, user.ID}},
+			{"suggestion_dismissals", &models.SuggestionDismissal{}, "user_id = ? OR dismissed_id = ?", []interface{}{user.ID, user.ID}},
+			{"session_invitations", &models.SessionInvitation{}, "inviter_id = ? OR invitee_id = ?", []interface{}{user.ID, user.ID}},
+			{"session_co_hosts", &models.SessionCoHost{}, "user_id = ?", []interface{}{user.ID}},
+			{"waiting_room_entries", &models.WaitingRoomEntry{}, "user_id = ?", []interface{}{user.ID}},
+			{"session_bans", &models.SessionBan{}, "user_id = ?", []interface{}{user.ID}},
+			{"user_sessions", &models.UserSession{}, "user_id = ?", []interface{}{user.ID}},
+			{"auth_tokens", &models.AuthToken{}, "user_id = ?", []interface{}{user.ID}},
+			{"api_keys", &models.APIKey{}, "user_id = ?", []interface{}{user.ID}},
+			{"recovery_codes", &models.RecoveryCode{}, "user_id = ?", []interface{}{user.ID}},
+			{"external_identities", &models.ExternalIdentity{}, "user_id = ?", []interface{}{user.ID}},
+			{"user_tokens", &models.UserToken{}, "user_id = ?", []interface{}{user.ID}},
+			{"data_exports", &models.DataExport{}, "user_id = ?", []interface{}{user.ID}},
+			{"user_preferences", &models.UserPreferences{}, "user_id = ?", []interface{}{user.ID}},
+			{"user_statuses", &models.UserStatus{}, "user_id = ?", []interface{}{user.ID}},
+			{"login_throttles", &models.LoginThrottle{}, "key = ? OR key LIKE ?", []interface{}{accountThrottleKey(user.Name), fmt.Sprintf("passcode:%d:%%", user.ID)}},
+		}
+		for _, d := range deletes {
+			result := tx.Unscoped().Where(d.query, d.args...).Delete(d.model)
+			if result.Error != nil {
+				return fmt.Errorf("purging %s: %w", d.table, result.Error)
+			}
+			report.DeletedRows[d.table] = result.RowsAffected
+		}
+
+		result := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", user.ID)
+		if result.Error != nil {
+			return fmt.Errorf("purging user_roles: %w", result.Error)
+		}
+		report.DeletedRows["user_roles"] = result.RowsAffected
+
+		result = tx.Unscoped().Delete(&models.User{}, user.ID)
+		if result.Error != nil {
+			return fmt.Errorf("purging users: %w", result.Error)
+		}
+		report.DeletedRows["users"] = result.RowsAffected
+
+		if dryRun {
+			return errPurgeDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPurgeDryRun) {
+		return nil, err
+	}
+
+	// Files cannot be rolled back, so they go only once the rows are gone for good
+	if !dryRun {
+		for _, path := range report.Media {
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("Failed to remove %s: %v", path, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// Finds a deactivated user by name
+func findDeactivatedUser(name string) (models.User, error) {
+	var user models.User
+	err := inits.DB.Unscoped().Where("name = ? AND deleted_at IS NOT NULL", name).First(&user).Error
+	return user, err
+}
+
+// UserReactivate restores a deactivated user before they are purged
+func UserReactivate(c *gin.Context) {
+	var input struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	user, err := findDeactivatedUser(input.Name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Deactivated user not found"})
+		return
+	}
+
+	if err := inits.DB.Unscoped().Model(&user).Update("deleted_at", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to reactivate user"})
+		return
+	}
+	Audit(c, "user.reactivate", "user", user.ID, user.Name, nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "User reactivated"})
+}
+
+// PurgeUser permanently removes a deactivated user, or reports what would be removed
+func PurgeUser(c *gin.Context) {
+	var input struct {
+		Name   string `json:"name" binding:"required"`
+		DryRun bool   `json:"dryRun"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	// Only deactivated users can be purged, deactivation is the undo window
+	user, err := findDeactivatedUser(input.Name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Deactivated user not found"})
+		return
+	}
+
+	report, err := purgeUser(user, input.DryRun)
+	if err != nil {
+		log.Printf("Failed to purge user %s: %v", user.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to purge user"})
+		return
+	}
+	if !input.DryRun {
+		Audit(c, "user.purge", "user", user.ID, user.Name, nil, report)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+// StartUserPurger periodically purges users whose grace period has run out, and expired or stalled data exports
+func StartUserPurger() {
+	ticker := time.NewTicker(time.Duration(viper.GetInt("users.purgeIntervalMinutes")) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pruneExpiredExports()
+		failStalledExports()
+		pruneOldNotifications()
+
+		var users []models.User
+		if err := inits.DB.Unscoped().Where("deleted_at < ?", time.Now().Add(-purgeGracePeriod())).Find(&users).Error; err != nil {
+			log.Printf("Failed to find users to purge: %v", err)
+			continue
+		}
+
+		for _, user := range users {
+			report, err := purgeUser(user, false)
+			if err != nil {
+				log.Printf("Failed to purge user %s: %v", user.Name, err)
+				continue
+			}
+			Audit(nil, "user.purge", "user", user.ID, user.Name, nil, report)
+			log.Printf("Purged user %s", user.Name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// All API keys start with this so they can be told apart from JWTs
+const apiKeyPrefix = "mz_"
+
+// Scopes an API key can be limited to, one read and one write scope per route group
+var apiKeyScopes = []string{
+	"users:read", "users:write",
+	"friends:read", "friends:write",
+	"notifications:read", "notifications:write",
+	"sessions:read", "sessions:write",
+	"video:read", "video:write",
+	"ws:read",
+	"admin:read", "admin:write",
+}
+
+// Route group of each route, by path prefix. The longest matching prefix wins. An empty
+// group marks routes no API key may call, scoped or not: a key must not manage keys or
+// change its owner's credentials, second factor or account.
+var apiKeyRouteGroups = map[string]string{
+	"/users":                "users",
+	"/users/keys":           "",
+	"/users/password":       "",
+	"/users/2fa":            "",
+	"/users/logout/all":     "",
+	"/users/me":             "",
+	"/users/me/preferences": "users",
+	"/users/me/status":      "users",
+	"/users/me/export":      "",
+	"/users/delete":         "admin",
+	"/users/reactivate":     "admin",
+	"/users/manager":        "admin",
+	"/users/revoke":         "admin",
+	"/users/unlock":         "admin",
+	"/users/roles":          "admin",
+	"/friends":              "friends",
+	"/notifications":        "notifications",
+	"/sessions":             "sessions",
+	"/video":                "video",
+	"/uploads":              "video",
+	"/ws":                   "ws",
+	"/admin":                "admin",
+	"/roles":                "admin",
+}
+
+// Finds the route group of a route, false if it has none
+func apiKeyRouteGroup(route string) (string, bool) {
+	best, group, found := -1, "", false
+	for prefix, g := range apiKeyRouteGroups {
+		if (route == prefix || strings.HasPrefix(route, prefix+"/")) && len(prefix) > best {
+			best, group, found = len(prefix), g, true
+		}
+	}
+	return group, found
+}
+
+// Extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Looks up an API key and returns the ID of the user it belongs to
+func authenticateAPIKey(c *gin.Context, key string) (string, error) {
+	var apiKey models.APIKey
+	if err := inits.DB.Where("key_hash = ? AND revoked_at IS NULL", hashToken(key)).First(&apiKey).Error; err != nil {
+		return "", fmt.Errorf("invalid API key")
+	}
+
+	now := time.Now()
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(now) {
+		return "", fmt.Errorf("API key expired")
+	}
+
+	inits.DB.Model(&apiKey).Update("last_used_at", now)
+
+	c.Set("apiKeyID", apiKey.ID)
+	c.Set("apiKeyScopes", splitScopes(apiKey.Scopes))
+	return fmt.Sprintf("%d", apiKey.UserID), nil
+}
+
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return nil
+	}
+	return strings.Split(scopes, ",")
+}
+
+// Returns the scope a route needs, e.g. "friends:write" for POST /friends/add, or "" if
+// API keys may not call it at all
+func requiredScope(c *gin.Context) string {
+	group, ok := apiKeyRouteGroup(c.FullPath())
+	if !ok || group == "" {
+		return ""
+	}
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return group + ":read"
+	}
+	return group + ":write"
+}
+
+// HasRequiredScope reports whether the request's API key, if any, is allowed on this route.
+// Unscoped keys reach every route that API keys may call at all.
+func HasRequiredScope(c *gin.Context) bool {
+	value, exists := c.Get("apiKeyScopes")
+	if !exists {
+		return true // Cookie and JWT bearer requests are not scoped
+	}
+	if group, ok := apiKeyRouteGroup(c.FullPath()); ok && group == "" {
+		return false
+	}
+	scopes, _ := value.([]string)
+	if len(scopes) == 0 {
+		return true
+	}
+	scope := requiredScope(c)
+	return scope != "" && slices.Contains(scopes, scope)
+}
+
+// CreateAPIKey creates a new personal API key and returns it once
+func CreateAPIKey(c *gin.Context) {
+	var input struct {
+		Name          string   `json:"name" binding:"required"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	for _, scope := range input.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Unknown scope %q", scope), "scopes": apiKeyScopes})
+			return
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate key"})
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := models.APIKey{
+		UserID:  userID,
+		Name:    input.Name,
+		Prefix:  key[:len(apiKeyPrefix)+6],
+		KeyHash: hashToken(key),
+		Scopes:  strings.Join(input.Scopes, ","),
+	}
+	if input.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, input.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if err := inits.DB.Create(&apiKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create key"})
+		return
+	}
+
+	// The plain key is only ever shown here, we keep just its hash
+	c.JSON(http.StatusOK, gin.H{"key": key, "apiKey": apiKey})
+}
+
+// ListAPIKeys lists the authenticated user's API keys
+func ListAPIKeys(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var keys []models.APIKey
+	if err := inits.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// RevokeAPIKey revokes one of the authenticated user's API keys
+func RevokeAPIKey(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var apiKey models.APIKey
+	if err := inits.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&apiKey).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "API key not found"})
+		return
+	}
+
+	if apiKey.RevokedAt == nil {
+		now := time.Now()
+		if err := inits.DB.Model(&apiKey).Update("revoked_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to revoke key"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// SetupAuditLog makes the audit table append-only at the database level
+func SetupAuditLog() {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_logs_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_logs is append-only';
+END;
+$$ LANGUAGE plpgsql`,
+		"DROP TRIGGER IF EXISTS audit_logs_no_change ON audit_logs",
+		"CREATE TRIGGER audit_logs_no_change BEFORE UPDATE OR DELETE ON audit_logs FOR EACH ROW EXECUTE FUNCTION audit_logs_append_only()",
+		"DROP TRIGGER IF EXISTS audit_logs_no_truncate ON audit_logs",
+		"CREATE TRIGGER audit_logs_no_truncate BEFORE TRUNCATE ON audit_logs FOR EACH STATEMENT EXECUTE FUNCTION audit_logs_append_only()",
+	}
+	for _, statement := range statements {
+		if err := inits.DB.Exec(statement).Error; err != nil {
+			log.Printf("Failed to protect the audit log: %v", err)
+			return
+		}
+	}
+}
+
+// Encodes a before or after value, nil stays empty
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return string(data)
+}
+
+// Audit records a privileged action taken by the user of the request. Pass a nil
+// context for actions of the system itself. A target ID of 0 means none.
+func Audit(c *gin.Context, action, targetType string, targetID uint, targetName string, before, after interface{}) {
+	entry := newAuditEntry(action, targetType, targetID, targetName, before, after)
+	if c == nil {
+		entry.ActorName = "system"
+	} else {
+		entry.IP = c.ClientIP()
+		entry.UserAgent = c.Request.UserAgent()
+		if userID, err := GetValidUserID(c); err == nil {
+			setAuditActor(&entry, userID)
+		}
+	}
+	writeAudit(entry)
+}
+
+// AuditAs records a privileged action of a user outside of an HTTP request, such as a websocket command
+func AuditAs(userID uint, action, targetType string, targetID uint, targetName string, before, after interface{}) {
+	entry := newAuditEntry(action, targetType, targetID, targetName, before, after)
+	setAuditActor(&entry, userID)
+	writeAudit(entry)
+}
+
+func newAuditEntry(action, targetType string, targetID uint, targetName string, before, after interface{}) models.AuditLog {
+	entry := models.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetName: targetName,
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+	if targetID != 0 {
+		entry.TargetID = &targetID
+	}
+	return entry
+}
+
+func setAuditActor(entry *models.AuditLog, userID uint) {
+	entry.ActorID = &userID
+	var actor models.User
+	if err := inits.DB.Unscoped().Select("name").First(&actor, userID).Error; err == nil {
+		entry.ActorName = actor.Name
+	}
+}
+
+// The action already happened, a failed audit write must not undo it but has to be visible
+func writeAudit(entry models.AuditLog) {
+	if err := inits.DB.Create(&entry).Error; err != nil {
+		log.Printf("AUDIT WRITE FAILED for %s on %s %q: %v", entry.Action, entry.TargetType, entry.TargetName, err)
+	}
+}
+
+// Builds the audit query from the filters in the query string
+func auditQuery(c *gin.Context) (*gorm.DB, error) {
+	query := inits.DB.Model(&models.AuditLog{})
+
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor_name = ?", actor)
+	}
+	if actorID := c.Query("actorId"); actorID != "" {
+		id, err := strconv.Atoi(actorID)
+		if err != nil {
+			return nil, errors.New("Invalid actorId")
+		}
+		query = query.Where("actor_id = ?", id)
+	}
+	if target := c.Query("target"); target != "" {
+		query = query.Where("target_name = ?", target)
+	}
+	if targetID := c.Query("targetId"); targetID != "" {
+		id, err := strconv.Atoi(targetID)
+		if err != nil {
+			return nil, errors.New("Invalid targetId")
+		}
+		query = query.Where("target_id = ?", id)
+	}
+	// "role.*" matches every role action
+	if action := c.Query("action"); action != "" {
+		if strings.HasSuffix(action, "*") {
+			query = query.Where(`action LIKE ? ESCAPE '\'`, escapeLike(strings.TrimSuffix(action, "*"))+"%")
+		} else {
+			query = query.Where("action = ?", action)
+		}
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := parseDirectoryTime(from)
+		if err != nil {
+			return nil, errors.New("Invalid from")
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseDirectoryTime(to)
+		if err != nil {
+			return nil, errors.New("Invalid to")
+		}
+		query = query.Where("created_at < ?", t)
+	}
+
+	return query, nil
+}
+
+// ListAuditLog returns audit entries, newest first
+//
+// Filters: actor, actorId, target, targetId, action (a trailing * matches a prefix),
+// from and to (RFC 3339 or YYYY-MM-DD). Pages with limit and the nextCursor of the previous page.
+func ListAuditLog(c *gin.Context) {
+	query, err := auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	limit := defaultAuditLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit"})
+			return
+		}
+		if n > maxAuditLimit {
+			n = maxAuditLimit
+		}
+		limit = n
+	}
+	// IDs only grow, so the last ID of a page is enough as a cursor
+	if cursor := c.Query("cursor"); cursor != "" {
+		id, err := strconv.Atoi(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid cursor"})
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	var entries []models.AuditLog
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching audit log"})
+		return
+	}
+
+	nextCursor := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		nextCursor = strconv.Itoa(int(entries[len(entries)-1].ID))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "nextCursor": nextCursor})
+}
+
+// Stops spreadsheet programs from running cell values as formulas
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func optionalID(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*id))
+}
+
+// ExportAuditLog streams the filtered audit log as CSV, oldest first
+func ExportAuditLog(c *gin.Context) {
+	query, err := auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	rows, err := query.Order("id").Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching audit log"})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.csv"`, time.Now().Format("2006-01-02")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "time", "actor_id", "actor", "action", "target_type", "target_id", "target", "before", "after", "ip", "user_agent"})
+	for rows.Next() {
+		var entry models.AuditLog
+		if err := inits.DB.ScanRows(rows, &entry); err != nil {
+			log.Printf("Failed to read audit entry: %v", err)
+			break
+		}
+		w.Write([]string{
+			strconv.Itoa(int(entry.ID)),
+			entry.CreatedAt.UTC().Format(time.RFC3339),
+			optionalID(entry.ActorID),
+			csvSafe(entry.ActorName),
+			csvSafe(entry.Action),
+			csvSafe(entry.TargetType),
+			optionalID(entry.TargetID),
+			csvSafe(entry.TargetName),
+			csvSafe(entry.Before),
+			csvSafe(entry.After),
+			csvSafe(entry.IP),
+			csvSafe(entry.UserAgent),
+		})
+	}
+	w.Flush()
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const avatarDir = "./uploads/avatars"
+
+// Thumbnail sizes written for every avatar, ImgPath points at the largest
+var avatarSizes = []int{64, 256}
+
+// Image types we accept, checked against the file content and not the client's header
+var avatarTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// Path of one thumbnail of an avatar
+func avatarFile(key string, size int) string {
+	return filepath.Join(avatarDir, fmt.Sprintf("%s-%d.png", key, size))
+}
+
+// Public URL of one thumbnail of an avatar
+func avatarURL(key string, size int) string {
+	return fmt.Sprintf("%s/uploads/avatars/%s-%d.png", strings.TrimRight(viper.GetString("server.publicUrl"), "/"), key, size)
+}
+
+// Deletes every thumbnail of an avatar
+func removeAvatarFiles(key string) {
+	if key == "" {
+		return
+	}
+	for _, size := range avatarSizes {
+		if err := os.Remove(avatarFile(key, size)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove avatar file: %v", err)
+		}
+	}
+}
+
+// Reads and decodes an uploaded avatar, rejecting anything that is not a small enough image
+func decodeAvatar(c *gin.Context) (*image.RGBA, int, string) {
+	maxBytes := viper.GetInt64("avatar.maxBytes")
+	// Leave room for the multipart headers around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+64*1024)
+
+	file, header, err := c.Request.FormFile("avatar")
+	if err != nil {
+		return nil, http.StatusBadRequest, "Missing avatar file or file too large"
+	}
+	defer file.Close()
+
+	if header.Size > maxBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Sprintf("Avatar must be at most %d KB", maxBytes/1024)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil || int64(len(data)) > maxBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Sprintf("Avatar must be at most %d KB", maxBytes/1024)
+	}
+
+	if !avatarTypes[http.DetectContentType(data)] {
+		return nil, http.StatusUnsupportedMediaType, "Avatar must be a JPEG, PNG or GIF image"
+	}
+
+	// Check the dimensions before decoding so a tiny file cannot expand into a huge bitmap
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid image"
+	}
+	maxDimension := viper.GetInt("avatar.maxDimension")
+	if config.Width < 1 || config.Height < 1 || config.Width > maxDimension || config.Height > maxDimension {
+		return nil, http.StatusBadRequest, fmt.Sprintf("Avatar must be at most %dx%d pixels", maxDimension, maxDimension)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid image"
+	}
+
+	// Re-encoding drops EXIF, so turn the pixels upright first
+	return utils.ApplyOrientation(img, utils.JPEGOrientation(data)), http.StatusOK, ""
+}
+
+// UploadAvatar replaces the authenticated user's avatar with an uploaded image
+func UploadAvatar(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	img, status, message := decodeAvatar(c)
+	if img == nil {
+		c.JSON(status, gin.H{"message": message})
+		return
+	}
+
+	suffix, err := randomToken(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to save avatar"})
+		return
+	}
+	// A new name for every upload so browsers and proxies never show a cached old picture
+	key := fmt.Sprintf("%d-%s", user.ID, suffix)
+
+	if err := os.MkdirAll(avatarDir, 0755); err != nil {
+		log.Printf("Failed to create avatar directory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to save avatar"})
+		return
+	}
+
+	thumbnails := gin.H{}
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, utils.SquareThumbnail(img, size)); err == nil {
+			err = os.WriteFile(avatarFile(key, size), buf.Bytes(), 0644)
+		}
+		if err != nil {
+			log.Printf("Failed to write avatar: %v", err)
+			removeAvatarFiles(key)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to save avatar"})
+			return
+		}
+		thumbnails[fmt.Sprint(size)] = avatarURL(key, size)
+	}
+
+	oldKey := user.AvatarKey
+	if err := inits.DB.Model(&user).Updates(map[string]interface{}{
+		"ImgPath":   avatarURL(key, avatarSizes[len(avatarSizes)-1]),
+		"AvatarKey": key,
+	}).Error; err != nil {
+		removeAvatarFiles(key)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to save avatar"})
+		return
+	}
+	removeAvatarFiles(oldKey)
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "thumbnails": thumbnails})
+}
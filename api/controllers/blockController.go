@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// HasBlocked reports whether blockerID has blocked userID
+func HasBlocked(blockerID, userID uint) bool {
+	var count int64
+	inits.DB.Model(&models.Block{}).Where("user_id = ? AND blocked_id = ?", blockerID, userID).Count(&count)
+	return count > 0
+}
+
+// IsBlocked reports whether either user has blocked the other. Anything that lets two
+// users reach each other directly, like direct messages once they exist, must check it.
+func IsBlocked(userID, otherID uint) bool {
+	var count int64
+	inits.DB.Model(&models.Block{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", userID, otherID, otherID, userID).
+		Count(&count)
+	return count > 0
+}
+
+// ListBlocks returns the users the authenticated user has blocked
+func ListBlocks(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	type blockedUser struct {
+		User      models.PublicUser `json:"user"`
+		BlockedAt time.Time         `json:"blockedAt"`
+	}
+
+	var blocks []models.Block
+	if err := inits.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&blocks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching blocked users"})
+		return
+	}
+
+	blocked := make([]blockedUser, 0, len(blocks))
+	for _, block := range blocks {
+		var user models.User
+		if err := inits.DB.First(&user, block.BlockedID).Error; err != nil {
+			continue
+		}
+		blocked = append(blocked, blockedUser{User: user.Public(), BlockedAt: block.CreatedAt})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blocked": blocked})
+}
+
+// BlockUser blocks another user and ends any friendship or open request between the two
+func BlockUser(c *gin.Context) {
+	var input struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var target models.User
+	if err := inits.DB.Where("name = ?", input.Name).First(&target).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if target.ID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot block yourself"})
+		return
+	}
+
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		block := models.Block{UserID: userID, BlockedID: target.ID}
+		if err := tx.Where(block).FirstOrCreate(&block).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+			userID, target.ID, target.ID, userID).Delete(&models.Friend{}).Error; err != nil {
+			return err
+		}
+		return forgetContact(tx, userID, target.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to block user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User blocked"})
+}
+
+// UnblockUser removes a block, it does not bring back the friendship
+func UnblockUser(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var target models.User
+	if err := inits.DB.Unscoped().Where("name = ?", c.Param("name")).First(&target).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	// Hard delete so the same user can be blocked again later
+	result := inits.DB.Unscoped().Where("user_id = ? AND blocked_id = ?", userID, target.ID).Delete(&models.Block{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to unblock user"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "This user is not blocked"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+}
@@ -0,0 +1,488 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Limits that keep a friend list and an invite list manageable
+const (
+	maxContactGroups = 50
+	maxGroupMembers  = 200
+)
+
+// Loads the accepted friends of userID with the given names, any other name is an error
+func friendsByName(userID uint, names []string) ([]models.User, error) {
+	unique := make([]string, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	if len(unique) == 0 {
+		return []models.User{}, nil
+	}
+
+	var users []models.User
+	if err := inits.DB.Where("name IN ?", unique).Find(&users).Error; err != nil {
+		return nil, errors.New("error fetching users")
+	}
+	byName := make(map[string]models.User, len(users))
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		byName[user.Name] = user
+		ids = append(ids, user.ID)
+	}
+
+	var friendships []models.Friend
+	inits.DB.Select("user_id", "friend_id").
+		Where("(user_id = ? AND friend_id IN ?) OR (friend_id = ? AND user_id IN ?)", userID, ids, userID, ids).
+		Where("status = ?", models.FriendAccepted).
+		Find(&friendships)
+	isFriend := make(map[uint]bool, len(friendships))
+	for _, friendship := range friendships {
+		if friendship.UserID == userID {
+			isFriend[friendship.FriendID] = true
+		} else {
+			isFriend[friendship.UserID] = true
+		}
+	}
+
+	friends := make([]models.User, 0, len(unique))
+	for _, name := range unique {
+		friend, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("user %q not found", name)
+		}
+		if !isFriend[friend.ID] {
+			return nil, fmt.Errorf("%q is not your friend", name)
+		}
+		friends = append(friends, friend)
+	}
+	return friends, nil
+}
+
+// Loads a group of the authenticated user from the :id parameter, responding itself on failure
+func ownGroup(c *gin.Context, userID uint) (models.ContactGroup, bool) {
+	var group models.ContactGroup
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid group ID"})
+		return group, false
+	}
+	if err := inits.DB.Where("id = ? AND user_id = ?", id, userID).First(&group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+		return group, false
+	}
+	return group, true
+}
+
+// Trims and checks a group name
+func validGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("Name is required")
+	}
+	if err := validateText("Name", name, 64, false); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Whether the user already has another group with this name
+func groupNameTaken(userID uint, name string, exceptID uint) bool {
+	var count int64
+	inits.DB.Model(&models.ContactGroup{}).Where("user_id = ? AND name = ? AND id <> ?", userID, name, exceptID).Count(&count)
+	return count > 0
+}
+
+// GroupMemberIDs returns the members of one of the user's groups who are still their friends
+func GroupMemberIDs(userID, groupID uint) ([]uint, error) {
+	var group models.ContactGroup
+	if err := inits.DB.Where("id = ? AND user_id = ?", groupID, userID).First(&group).Error; err != nil {
+		return nil, errors.New("group not found")
+	}
+
+	var ids []uint
+	err := inits.DB.Model(&models.ContactGroupMember{}).
+		Joins("JOIN friends ON friends.status = ? AND friends.deleted_at IS NULL AND "+
+			"((friends.user_id = ? AND friends.friend_id = contact_group_members.friend_id) OR "+
+			"(friends.friend_id = ? AND friends.user_id = contact_group_members.friend_id))",
+			models.FriendAccepted, userID, userID).
+		Where("contact_group_members.group_id = ?", group.ID).
+		Pluck("contact_group_members.friend_id", &ids).Error
+	return ids, err
+}
+
+// Removes every favorite and group membership between two users, for when they stop being friends
+func forgetContact(tx *gorm.DB, userID, otherID uint) error {
+	if err := tx.Unscoped().
+		Where("(user_id = ? AND favorite_id = ?) OR (user_id = ? AND favorite_id = ?)", userID, otherID, otherID, userID).
+		Delete(&models.Favorite{}).Error; err != nil {
+		return err
+	}
+	for _, pair := range [][2]uint{{userID, otherID}, {otherID, userID}} {
+		if err := tx.Unscoped().
+			Where("friend_id = ? AND group_id IN (?)", pair[1], tx.Model(&models.ContactGroup{}).Select("id").Where("user_id = ?", pair[0])).
+			Delete(&models.ContactGroupMember{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type contactGroupResponse struct {
+	ID       uint                `json:"id"`
+	Name     string              `json:"name"`
+	Position int                 `json:"position"`
+	Members  []models.PublicUser `json:"members"`
+}
+
+func groupResponse(group models.ContactGroup) contactGroupResponse {
+	return groupResponses([]models.ContactGroup{group})[0]
+}
+
+// Builds the responses of several groups, loading all their members in one query
+func groupResponses(groups []models.ContactGroup) []contactGroupResponse {
+	var memberIDs []uint
+	for _, group := range groups {
+		for _, member := range group.Members {
+			memberIDs = append(memberIDs, member.FriendID)
+		}
+	}
+	users := map[uint]models.User{}
+	if len(memberIDs) > 0 {
+		var found []models.User
+		inits.DB.Where("id IN ?", memberIDs).Find(&found)
+		for _, user := range found {
+			users[user.ID] = user
+		}
+	}
+
+	responses := make([]contactGroupResponse, 0, len(groups))
+	for _, group := range groups {
+		response := contactGroupResponse{ID: group.ID, Name: group.Name, Position: group.Position, Members: []models.PublicUser{}}
+		for _, member := range group.Members {
+			if user, ok := users[member.FriendID]; ok {
+				response.Members = append(response.Members, user.Public())
+			}
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// ListContactGroups returns the authenticated user's groups in their order, with members
+func ListContactGroups(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var groups []models.ContactGroup
+	if err := inits.DB.Preload("Members").Where("user_id = ?", userID).Order("position, id").Find(&groups).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching groups"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"groups": groupResponses(groups)})
+}
+
+// CreateContactGroup creates a group at the end of the list, optionally with members
+func CreateContactGroup(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var input struct {
+		Name    string   `json:"name" binding:"required"`
+		Members []string `json:"members"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	name, err := validGroupName(input.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if groupNameTaken(userID, name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"message": "You already have a group with this name"})
+		return
+	}
+	if len(input.Members) > maxGroupMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("A group can have at most %d members", maxGroupMembers)})
+		return
+	}
+	members, err := friendsByName(userID, input.Members)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	var count int64
+	inits.DB.Model(&models.ContactGroup{}).Where("user_id = ?", userID).Count(&count)
+	if count >= maxContactGroups {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("You can have at most %d groups", maxContactGroups)})
+		return
+	}
+
+	var position int
+	inits.DB.Model(&models.ContactGroup{}).Where("user_id = ?", userID).Select("COALESCE(MAX(position), -1) + 1").Scan(&position)
+
+	group := models.ContactGroup{UserID: userID, Name: name, Position: position}
+	for _, member := range members {
+		group.Members = append(group.Members, models.ContactGroupMember{FriendID: member.ID})
+	}
+	if err := inits.DB.Create(&group).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create group"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"group": groupResponse(group)})
+}
+
+// RenameContactGroup changes the name of a group
+func RenameContactGroup(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	group, ok := ownGroup(c, userID)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	name, err := validGroupName(input.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if groupNameTaken(userID, name, group.ID) {
+		c.JSON(http.StatusConflict, gin.H{"message": "You already have a group with this name"})
+		return
+	}
+
+	if err := inits.DB.Model(&group).Update("name", name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to rename group"})
+		return
+	}
+
+	inits.DB.Preload("Members").First(&group, group.ID)
+	c.JSON(http.StatusOK, gin.H{"group": groupResponse(group)})
+}
+
+// ReorderContactGroups takes all of the user's group IDs in their new order
+func ReorderContactGroups(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var input struct {
+		IDs []uint `json:"ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	// A partial list would leave two groups on the same position
+	var ids []uint
+	inits.DB.Model(&models.ContactGroup{}).Where("user_id = ?", userID).Pluck("id", &ids)
+	owned := map[uint]bool{}
+	for _, id := range ids {
+		owned[id] = true
+	}
+	if len(input.IDs) != len(ids) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "ids must list every one of your groups once"})
+		return
+	}
+	for _, id := range input.IDs {
+		if !owned[id] {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "ids must list every one of your groups once"})
+			return
+		}
+		delete(owned, id)
+	}
+
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		for position, id := range input.IDs {
+			if err := tx.Model(&models.ContactGroup{}).Where("id = ?", id).Update("position", position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to reorder groups"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Groups reordered"})
+}
+
+// DeleteContactGroup deletes a group, the friends in it stay friends
+func DeleteContactGroup(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	group, ok := ownGroup(c, userID)
+	if !ok {
+		return
+	}
+
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("group_id = ?", group.ID).Delete(&models.ContactGroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&group).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to delete group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted"})
+}
+
+// AddGroupMembers adds friends to a group, names already in it are ignored
+func AddGroupMembers(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	group, ok := ownGroup(c, userID)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Names []string `json:"names" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	friends, err := friendsByName(userID, input.Names)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	var count int64
+	inits.DB.Model(&models.ContactGroupMember{}).Where("group_id = ?", group.ID).Count(&count)
+	if int(count)+len(friends) > maxGroupMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("A group can have at most %d members", maxGroupMembers)})
+		return
+	}
+
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		for _, friend := range friends {
+			member := models.ContactGroupMember{GroupID: group.ID, FriendID: friend.ID}
+			if err := tx.Where(member).FirstOrCreate(&member).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to add members"})
+		return
+	}
+
+	inits.DB.Preload("Members").First(&group, group.ID)
+	c.JSON(http.StatusOK, gin.H{"group": groupResponse(group)})
+}
+
+// RemoveGroupMembers takes friends out of a group
+func RemoveGroupMembers(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	group, ok := ownGroup(c, userID)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Names []string `json:"names" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	// Former friends and deactivated users can be removed too, so look names up without further checks
+	if err := inits.DB.Unscoped().
+		Where("group_id = ? AND friend_id IN (?)", group.ID, inits.DB.Unscoped().Model(&models.User{}).Select("id").Where("name IN ?", input.Names)).
+		Delete(&models.ContactGroupMember{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to remove members"})
+		return
+	}
+
+	inits.DB.Preload("Members").First(&group, group.ID)
+	c.JSON(http.StatusOK, gin.H{"group": groupResponse(group)})
+}
+
+// SetFavorite stars (PUT) or unstars (DELETE) the friend named in the URL
+func SetFavorite(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	if c.Request.Method == http.MethodDelete {
+		if err := inits.DB.Unscoped().
+			Where("user_id = ? AND favorite_id IN (?)", userID, inits.DB.Unscoped().Model(&models.User{}).Select("id").Where("name = ?", c.Param("name"))).
+			Delete(&models.Favorite{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to remove favorite"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Favorite removed"})
+		return
+	}
+
+	friends, err := friendsByName(userID, []string{c.Param("name")})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	favorite := models.Favorite{UserID: userID, FavoriteID: friends[0].ID}
+	if err := inits.DB.Where(favorite).FirstOrCreate(&favorite).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to add favorite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Favorite added"})
+}
@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"yuval/inits"
+	"yuval/mailer"
+	"yuval/models"
+	"yuval/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Validates an email address and returns it in the lower case form we store
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", fmt.Errorf("invalid email address")
+	}
+	return strings.ToLower(address.Address), nil
+}
+
+// Checks if another user already uses the email address
+func isEmailTaken(email string, exceptUserID uint) bool {
+	var count int64
+	inits.DB.Model(&models.User{}).Where("email = ? AND id != ?", email, exceptUserID).Count(&count)
+	return count > 0
+}
+
+// Creates a single-use token, replacing any unused token of the same purpose
+func createUserToken(user models.User, purpose string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).Delete(&models.UserToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.UserToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			TokenHash: hashToken(token),
+			Email:     user.Email,
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Marks a token as used and returns it, failing if it is unknown, used or expired
+func consumeUserToken(tx *gorm.DB, token, purpose string) (*models.UserToken, error) {
+	var userToken models.UserToken
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND purpose = ?", hashToken(token), purpose).
+		First(&userToken).Error; err != nil {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	now := time.Now()
+	if userToken.UsedAt != nil || userToken.ExpiresAt.Before(now) {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	userToken.UsedAt = &now
+	if err := tx.Save(&userToken).Error; err != nil {
+		return nil, err
+	}
+	return &userToken, nil
+}
+
+// Builds a link to a page of the frontend
+func appLink(path, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", strings.TrimRight(viper.GetString("app.url"), "/"), path, token)
+}
+
+// Mails the user a link that verifies their email address
+func sendVerificationEmail(user models.User) error {
+	if user.Email == "" {
+		return errors.New("user has no email address")
+	}
+
+	token, err := createUserToken(user, models.TokenVerifyEmail, time.Duration(viper.GetInt("email.verifyTokenHours"))*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n%s\n\nIf you did not sign up, you can ignore this email.\n",
+		user.Name, appLink("/verify-email", token))
+	return mailer.Mailer.Send(user.Email, "Confirm your email address", body)
+}
+
+// SendVerificationEmail sends a new verification link to the authenticated user
+func SendVerificationEmail(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if user.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "No email address set"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// VerifyEmail confirms an email address with the token from the verification link
+func VerifyEmail(c *gin.Context) {
+	var input struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	err := inits.DB.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, input.Token, models.TokenVerifyEmail)
+		if err != nil {
+			return err
+		}
+
+		// The address may have changed since the link was sent
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND email = ?", userToken.UserID, userToken.Email).
+			Update("email_verified", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("invalid or expired token")
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// ForgotPassword mails a password reset link if the address belongs to a user
+func ForgotPassword(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	// Always give the same answer so the endpoint cannot be used to find registered addresses
+	response := gin.H{"message": "If the address is registered, a reset link has been sent"}
+
+	email, err := normalizeEmail(input.Email)
+	if err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// Do not flood the inbox, one link per minute is enough
+	var recent int64
+	inits.DB.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, models.TokenResetPassword, time.Now().Add(-time.Minute)).
+		Count(&recent)
+	if recent > 0 {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := createUserToken(user, models.TokenResetPassword, time.Duration(viper.GetInt("email.resetTokenMinutes"))*time.Minute)
+	if err != nil {
+		log.Printf("Failed to create reset token: %v", err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset your password. Open this link to choose a new one:\n%s\n\nThe link works once and expires in %d minutes. If it was not you, you can ignore this email.\n",
+		user.Name, appLink("/reset-password", token), viper.GetInt("email.resetTokenMinutes"))
+	if err := mailer.Mailer.Send(user.Email, "Reset your password", body); err != nil {
+		log.Printf("Failed to send reset email: %v", err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword sets a new password with the token from the reset link
+func ResetPassword(c *gin.Context) {
+	var input struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	var user models.User
+	err := inits.DB.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, input.Token, models.TokenResetPassword)
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&user, userToken.UserID).Error; err != nil {
+			return errors.New("invalid or expired token")
+		}
+
+		// A rejected password rolls back the transaction, so the link can be used again
+		if err := utils.ValidatePassword(input.Password, user.Name); err != nil {
+			return err
+		}
+		password, err := utils.HashPassword(input.Password)
+		if err != nil {
+			return errors.New("error hashing password")
+		}
+
+		// Following the mailed link proves the address belongs to the user
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"password":             password,
+			"email_verified":       user.EmailVerified || user.Email == userToken.Email,
+			"must_change_password": false,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Whoever knew the old password must not stay signed in
+	if err := RevokeAllUserTokens(user.ID, "password reset"); err != nil {
+		log.Printf("Failed to revoke tokens after password reset: %v", err)
+	}
+	if err := clearLoginFailures(accountThrottleKey(user.Name)); err != nil {
+		log.Printf("Failed to clear login failures: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
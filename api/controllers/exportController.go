@@ -0,0 +1,449 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const exportDir = "./exports"
+
+// Writes a value as an indented JSON file into the archive
+func writeExportJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// Copies a file from disk into the archive, missing files are skipped
+func writeExportFile(zw *zip.Writer, name, path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Writes the archive with everything stored about the user
+func writeDataExport(zw *zip.Writer, user models.User) error {
+	if err := writeExportJSON(zw, "profile.json", gin.H{
+		"user":        user,
+		"permissions": GetUserPermissions(user.ID),
+		"preferences": models.PreferencesFor(inits.DB, user.ID),
+	}); err != nil {
+		return err
+	}
+
+	var connections []models.Friend
+	if err := inits.DB.Where("user_id = ? OR friend_id = ?", user.ID, user.ID).Find(&connections).Error; err != nil {
+		return err
+	}
+	type friendship struct {
+		Friend        string    `json:"friend"`
+		Accepted      bool      `json:"accepted"`
+		Status        string    `json:"status"`
+		RequestedByMe bool      `json:"requestedByMe"`
+		Since         time.Time `json:"since"`
+	}
+	friendships := make([]friendship, 0, len(connections))
+	for _, conn := range connections {
+		otherID := conn.FriendID
+		if conn.FriendID == user.ID {
+			otherID = conn.UserID
+		}
+		var other models.User
+		inits.DB.Unscoped().Select("name").First(&other, otherID)
+		friendships = append(friendships, friendship{
+			Friend:        other.Name,
+			Accepted:      conn.Accepted,
+			Status:        conn.Status,
+			RequestedByMe: conn.UserID == user.ID,
+			Since:         conn.CreatedAt,
+		})
+	}
+	if err := writeExportJSON(zw, "friendships.json", friendships); err != nil {
+		return err
+	}
+
+	var blocks []models.Block
+	if err := inits.DB.Where("user_id = ?", user.ID).Find(&blocks).Error; err != nil {
+		return err
+	}
+	type blockedUser struct {
+		User      string    `json:"user"`
+		BlockedAt time.Time `json:"blockedAt"`
+	}
+	blocked := make([]blockedUser, 0, len(blocks))
+	for _, block := range blocks {
+		var other models.User
+		inits.DB.Unscoped().Select("name").First(&other, block.BlockedID)
+		blocked = append(blocked, blockedUser{User: other.Name, BlockedAt: block.CreatedAt})
+	}
+	if err := writeExportJSON(zw, "blocks.json", blocked); err != nil {
+		return err
+	}
+
+	var groups []models.ContactGroup
+	if err := inits.DB.Preload("Members").Where("user_id = ?", user.ID).Order("position").Find(&groups).Error; err != nil {
+		return err
+	}
+	type contactGroup struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}
+	contactGroups := make([]contactGroup, 0, len(groups))
+	for _, group := range groups {
+		exported := contactGroup{Name: group.Name, Members: []string{}}
+		for _, member := range group.Members {
+			var other models.User
+			inits.DB.Unscoped().Select("name").First(&other, member.FriendID)
+			exported.Members = append(exported.Members, other.Name)
+		}
+		contactGroups = append(contactGroups, exported)
+	}
+	var favorites []string
+	inits.DB.Unscoped().Model(&models.User{}).
+		Where("id IN (?)", inits.DB.Model(&models.Favorite{}).Select("favorite_id").Where("user_id = ?", user.ID)).
+		Pluck("name", &favorites)
+	if err := writeExportJSON(zw, "contacts.json", gin.H{"groups": contactGroups, "favorites": favorites}); err != nil {
+		return err
+	}
+
+	var notifications []models.Notification
+	if err := inits.DB.Where("user_id = ?", user.ID).Order("id").Find(&notifications).Error; err != nil {
+		return err
+	}
+	if err := writeExportJSON(zw, "notifications.json", notifications); err != nil {
+		return err
+	}
+
+	var invitations []models.SessionInvitation
+	if err := inits.DB.Where("inviter_id = ? OR invitee_id = ?", user.ID, user.ID).Order("id").Find(&invitations).Error; err != nil {
+		return err
+	}
+	if err := writeExportJSON(zw, "invitations.json", invitationResponses(invitations)); err != nil {
+		return err
+	}
+
+	var userSessions []models.UserSession
+	if err := inits.DB.Preload("Session").Where("user_id = ?", user.ID).Order("joined_at").Find(&userSessions).Error; err != nil {
+		return err
+	}
+	type attendance struct {
+		SessionID uint       `json:"sessionId"`
+		Session   string     `json:"session"`
+		Host      bool       `json:"host"`
+		JoinedAt  time.Time  `json:"joinedAt"`
+		LeftAt    *time.Time `json:"leftAt"`
+	}
+	sessions := make([]attendance, 0, len(userSessions))
+	sessionIDs := map[uint]bool{}
+	for _, us := range userSessions {
+		entry := attendance{
+			SessionID: us.SessionID,
+			Session:   us.Session.Name,
+			Host:      us.Session.HostID == user.ID,
+			JoinedAt:  time.Unix(int64(us.JoinedAt), 0),
+		}
+		if us.LeftAt != 0 {
+			leftAt := time.Unix(int64(us.LeftAt), 0)
+			entry.LeftAt = &leftAt
+		}
+		sessions = append(sessions, entry)
+		sessionIDs[us.SessionID] = true
+	}
+	if err := writeExportJSON(zw, "sessions.json", sessions); err != nil {
+		return err
+	}
+
+	// Recordings, both the DASH segments and the converted MP4
+	for sessionID := range sessionIDs {
+		session := fmt.Sprint(sessionID)
+		userDir := filepath.Join("./uploads", session, fmt.Sprint(user.ID))
+		err := filepath.WalkDir(userDir, func(path string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(userDir, path)
+			if err != nil {
+				return err
+			}
+			return writeExportFile(zw, filepath.ToSlash(filepath.Join("recordings", session, rel)), path)
+		})
+		if err != nil {
+			return err
+		}
+		vodPath := filepath.Join("./uploads", session, "vod", fmt.Sprintf("%d.mp4", user.ID))
+		if err := writeExportFile(zw, filepath.ToSlash(filepath.Join("recordings", session, "recording.mp4")), vodPath); err != nil {
+			return err
+		}
+	}
+
+	if user.AvatarKey != "" {
+		size := avatarSizes[len(avatarSizes)-1]
+		if err := writeExportFile(zw, "avatar.png", avatarFile(user.AvatarKey, size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Builds the archive of an export in the background and records the outcome
+func buildDataExport(export models.DataExport) {
+	fail := func(err error) {
+		log.Printf("Data export %d failed: %v", export.ID, err)
+		inits.DB.Model(&export).Updates(map[string]interface{}{"status": models.ExportFailed, "error": "Failed to build the export"})
+	}
+
+	var user models.User
+	if err := inits.DB.Preload("Roles").First(&user, export.UserID).Error; err != nil {
+		fail(err)
+		return
+	}
+
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		fail(err)
+		return
+	}
+	suffix, err := randomToken(16)
+	if err != nil {
+		fail(err)
+		return
+	}
+	path := filepath.Join(exportDir, fmt.Sprintf("%d-%s.zip", user.ID, suffix))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		fail(err)
+		return
+	}
+	zw := zip.NewWriter(file)
+	err = writeDataExport(zw, user)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		fail(err)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	expiresAt := time.Now().Add(time.Duration(viper.GetInt("exports.ttlHours")) * time.Hour)
+	inits.DB.Model(&export).Updates(map[string]interface{}{
+		"status":     models.ExportReady,
+		"file_path":  path,
+		"size":       info.Size(),
+		"expires_at": expiresAt,
+	})
+}
+
+// Exports still pending that started before this were lost to a crash or restart
+func exportPendingDeadline() time.Time {
+	return time.Now().Add(-time.Duration(viper.GetInt("exports.pendingTimeoutMinutes")) * time.Minute)
+}
+
+func exportStalled(export models.DataExport) bool {
+	return export.Status == models.ExportPending && export.CreatedAt.Before(exportPendingDeadline())
+}
+
+// Marks stalled exports as failed so their owners can request a new one
+func failStalledExports() {
+	if err := inits.DB.Model(&models.DataExport{}).
+		Where("status = ? AND created_at < ?", models.ExportPending, exportPendingDeadline()).
+		Updates(map[string]interface{}{"status": models.ExportFailed, "error": "The export did not finish in time"}).Error; err != nil {
+		log.Printf("Failed to fail stalled exports: %v", err)
+	}
+}
+
+// Deletes exports whose download window is over
+func pruneExpiredExports() {
+	var exports []models.DataExport
+	if err := inits.DB.Where("expires_at < ?", time.Now()).Find(&exports).Error; err != nil {
+		log.Printf("Failed to find expired exports: %v", err)
+		return
+	}
+	for _, export := range exports {
+		if export.FilePath != "" {
+			if err := os.Remove(export.FilePath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove export %d: %v", export.ID, err)
+				continue
+			}
+		}
+		inits.DB.Unscoped().Delete(&export)
+	}
+}
+
+// Response body describing an export
+func exportResponse(export models.DataExport) gin.H {
+	response := gin.H{"export": export}
+	if export.Status == models.ExportReady {
+		response["downloadUrl"] = fmt.Sprintf("/users/me/export/%d/download", export.ID)
+	}
+	return response
+}
+
+// RequestDataExport returns the user's current data export, starting a new one if there is none
+//
+// Pass refresh=true to build a new archive even if a recent one is ready.
+func RequestDataExport(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var latest models.DataExport
+	found := inits.DB.Where("user_id = ?", userID).Order("id DESC").First(&latest).Error == nil
+	if found {
+		switch {
+		case latest.Status == models.ExportPending && !exportStalled(latest):
+			// One export at a time, building one is expensive
+			c.JSON(http.StatusAccepted, exportResponse(latest))
+			return
+		case latest.Status == models.ExportReady && latest.ExpiresAt != nil && latest.ExpiresAt.After(time.Now()) && c.Query("refresh") != "true":
+			c.JSON(http.StatusOK, exportResponse(latest))
+			return
+		}
+	}
+
+	if found && exportStalled(latest) {
+		inits.DB.Model(&latest).Updates(map[string]interface{}{"status": models.ExportFailed, "error": "The export did not finish in time"})
+	}
+
+	export := models.DataExport{UserID: userID, Status: models.ExportPending}
+	if err := inits.DB.Create(&export).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to start export"})
+		return
+	}
+	go buildDataExport(export)
+
+	c.JSON(http.StatusAccepted, exportResponse(export))
+}
+
+// DownloadDataExport sends a finished export archive to its owner
+func DownloadDataExport(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid ID"})
+		return
+	}
+
+	var export models.DataExport
+	if err := inits.DB.Where("id = ? AND user_id = ?", id, userID).First(&export).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Export not found"})
+		return
+	}
+	if export.Status != models.ExportReady || export.ExpiresAt == nil || export.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Export is not available"})
+		return
+	}
+
+	c.FileAttachment(export.FilePath, fmt.Sprintf("my-zoom-export-%s.zip", export.CreatedAt.Format("2006-01-02")))
+}
+
+// DeleteOwnAccount deactivates the authenticated user after checking their password,
+// or a recent re-authentication with their identity provider
+func DeleteOwnAccount(c *gin.Context) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	// Wrong passwords count towards the login lockout, so this cannot be used to guess it
+	if !recentlyReauthenticated(c, user.ID) {
+		accountKey := accountThrottleKey(user.Name)
+		if remaining := loginLockRemaining(accountKey); remaining > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many failed attempts, try again later"})
+			return
+		}
+		if err := utils.CheckPassword(user.Password, input.Password); err != nil {
+			if err := recordLoginFailure(accountKey, viper.GetInt("login.maxAttempts")); err != nil {
+				log.Printf("Failed to record login failure: %v", err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Password is incorrect"})
+			return
+		}
+	}
+
+	if user.Manager && countUsersWithRole(models.RoleAdmin) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot delete the last admin"})
+		return
+	}
+
+	// Same path as an admin delete: deactivate now, purge after the grace period
+	if err := deactivateUser(&user, "account deleted by user"); err != nil {
+		log.Printf("Failed to deactivate user %s: %v", user.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to delete account"})
+		return
+	}
+	clearAuthCookies(c)
+	// The request's user is deactivated by now, so the actor is passed explicitly
+	AuditAs(user.ID, "user.delete_self", "user", user.ID, user.Name, nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Account deleted",
+		"purgeAfter": time.Now().Add(purgeGracePeriod()),
+	})
+}
@@ -1,14 +1,34 @@
 package controllers
 
 import (
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 	"yuval/inits"
 	"yuval/models"
+	"yuval/userhub"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
+// SyncFriendStatus fills in the status of friendships created before it existed
+func SyncFriendStatus() {
+	if err := inits.DB.Model(&models.Friend{}).
+		Where("accepted = ? AND status <> ?", true, models.FriendAccepted).
+		Update("status", models.FriendAccepted).Error; err != nil {
+		log.Printf("Failed to sync friend status: %v", err)
+	}
+}
+
+// Friendships and open requests between two users, in either direction
+func activeFriendships(userID, otherID uint) *gorm.DB {
+	return inits.DB.
+		Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)", userID, otherID, otherID, userID).
+		Where("status IN ?", []string{models.FriendPending, models.FriendAccepted})
+}
+
 // AddFriend creates a mutual friendship between the authenticated user and another user
 func AddFriend(c *gin.Context) {
 	var req struct {
@@ -44,24 +64,41 @@ func AddFriend(c *gin.Context) {
 		return
 	}
 
-	// Check if already friends (in either direction)
+	// Someone who blocked the user looks the same as someone who does not exist
+	if HasBlocked(friend.ID, user.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Friend user not found"})
+		return
+	}
+	if HasBlocked(user.ID, friend.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unblock this user before sending a friend request"})
+		return
+	}
+
+	// Check if already friends or a request is open (in either direction)
 	var existing models.Friend
-	if err := inits.DB.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
-		user.ID, friend.ID, friend.ID, user.ID).First(&existing).Error; err == nil {
-		if existing.Accepted {
+	if err := activeFriendships(user.ID, friend.ID).First(&existing).Error; err == nil {
+		switch {
+		case existing.Status == models.FriendAccepted:
 			c.JSON(http.StatusBadRequest, gin.H{"message": "Already friends"})
-			return
+		case existing.UserID == friend.ID:
+			c.JSON(http.StatusBadRequest, gin.H{"message": "This user already sent you a friend request, accept it instead"})
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Friend request already sent, waiting for acceptance"})
 		}
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Friend request already sent, waiting for acceptance"})
 		return
 	}
 
 	// Create pending friendship (Accepted = false)
-	inits.DB.Create(&models.Friend{
+	if err := inits.DB.Create(&models.Friend{
 		UserID:   user.ID,
 		FriendID: friend.ID,
 		Accepted: false,
-	})
+		Status:   models.FriendPending,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to send friend request"})
+		return
+	}
+	userhub.Notify(friend.ID, models.NotifyFriendRequest, &user)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Friend request sent"})
 }
@@ -93,8 +130,16 @@ func DeleteFriend(c *gin.Context) {
 		return
 	}
 
-	inits.DB.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+	result := inits.DB.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
 		user.ID, friend.ID, friend.ID, user.ID).Delete(&models.Friend{})
+	if result.RowsAffected > 0 {
+		if err := forgetContact(inits.DB, user.ID, friend.ID); err != nil {
+			log.Printf("Failed to remove %s from the groups of %s: %v", friend.Name, user.Name, err)
+		}
+		clearFriendRequestNotification(friend.ID, user.ID)
+		clearFriendRequestNotification(user.ID, friend.ID)
+		userhub.Notify(friend.ID, models.NotifyFriendRemoved, &user)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Friendship deleted"})
 }
@@ -125,10 +170,7 @@ func CheckFriendship(c *gin.Context) {
 
 	// Check if friendship exists in either direction
 	var existing models.Friend
-	if err := inits.DB.
-		Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
-			userIDUint, friend.ID, friend.ID, userIDUint).
-		First(&existing).Error; err == nil {
+	if err := activeFriendships(uint(userIDUint), friend.ID).First(&existing).Error; err == nil {
 		c.JSON(http.StatusOK, gin.H{"friends": true})
 		return
 	}
@@ -167,65 +209,300 @@ func AcceptFriendship(c *gin.Context) {
 	}
 
 	// Only accept if the current user is the recipient of a pending request
-	var request models.Friend
-	if err := inits.DB.
-		Where("user_id = ? AND friend_id = ? AND accepted = false", sender.ID, userIDUint).
-		First(&request).Error; err == nil {
-		request.Accepted = true
-		inits.DB.Save(&request)
-		c.JSON(http.StatusOK, gin.H{"message": "Friendship accepted"})
+	if err := respondToFriendRequest(sender.ID, uint(userIDUint), models.FriendAccepted); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No pending friendship request from this user"})
 		return
 	}
 
-	c.JSON(http.StatusNotFound, gin.H{"message": "No pending friendship request from this user"})
+	var user models.User
+	inits.DB.First(&user, userIDUint)
+	clearFriendRequestNotification(user.ID, sender.ID)
+	userhub.Notify(sender.ID, models.NotifyFriendAccepted, &user)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friendship accepted"})
 }
 
-func GetFriends(c *gin.Context) {
-	isAuth, userIDStr := IsUserAuthenticatedGetId(c)
-	if !isAuth {
+// Moves the pending request from sender to recipient into its final status
+func respondToFriendRequest(senderID, recipientID uint, status string) error {
+	now := time.Now()
+	result := inits.DB.Model(&models.Friend{}).
+		Where("user_id = ? AND friend_id = ? AND status = ?", senderID, recipientID, models.FriendPending).
+		Updates(map[string]interface{}{
+			"status":       status,
+			"accepted":     status == models.FriendAccepted,
+			"responded_at": now,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeclineFriendship turns down a pending request sent to the authenticated user
+func DeclineFriendship(c *gin.Context) {
+	var body struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request body"})
 		return
 	}
 
-	userIDUint, err := strconv.ParseUint(userIDStr, 10, 64)
+	userID, err := GetValidUserID(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Invalid user ID"})
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
 		return
 	}
 
-	var connections []models.Friend
-	if err := inits.DB.Where("user_id = ? OR friend_id = ?", userIDUint, userIDUint).Find(&connections).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching friendships"})
+	var sender models.User
+	if err := inits.DB.Where("name = ?", body.Name).First(&sender).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
 		return
 	}
 
-	type FriendInfo struct {
-		User                 models.User `json:"user"`
-		Accepted             bool        `json:"accepted"`
-		ThisUserNeedToAccept bool        `json:"thisUserNeedToAccept"`
-	}
-
-	var friendInfos []FriendInfo
-	for _, conn := range connections {
-		var friendID uint
-		if conn.UserID == uint(userIDUint) {
-			friendID = conn.FriendID
-		} else {
-			friendID = conn.UserID
+	if err := respondToFriendRequest(sender.ID, userID, models.FriendDeclined); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No pending friendship request from this user"})
+		return
+	}
+
+	var user models.User
+	inits.DB.First(&user, userID)
+	clearFriendRequestNotification(userID, sender.ID)
+	userhub.Notify(sender.ID, models.NotifyFriendDeclined, &user)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request declined"})
+}
+
+// CancelFriendRequest withdraws a pending request the authenticated user sent
+func CancelFriendRequest(c *gin.Context) {
+	var body struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request body"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	// The recipient may have been deactivated since, the request can still be withdrawn
+	var recipient models.User
+	if err := inits.DB.Unscoped().Where("name = ?", body.Name).First(&recipient).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if err := respondToFriendRequest(userID, recipient.ID, models.FriendCancelled); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No pending friendship request to this user"})
+		return
+	}
+
+	var user models.User
+	inits.DB.First(&user, userID)
+	clearFriendRequestNotification(recipient.ID, userID)
+	userhub.Notify(recipient.ID, models.NotifyFriendCancelled, &user)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request cancelled"})
+}
+
+const (
+	defaultFriendLimit = 50
+	maxFriendLimit     = 100
+)
+
+// Every friendship of @me with the other user, the number of friends they share and the
+// last session both were in at the same time. Filters and the cursor are appended.
+const friendListQuery = `
+SELECT u.*,
+	f.id AS friendship_id,
+	f.status AS friendship_status,
+	f.user_id AS sender_id,
+	mutual.count AS mutual_friends,
+	met.session_id AS met_session_id,
+	met.session_name AS met_session_name,
+	met.met_at AS met_at,
+	EXISTS (
+		SELECT 1 FROM favorites fav
+		WHERE fav.user_id = @me AND fav.favorite_id = u.id AND fav.deleted_at IS NULL) AS favorite,
+	COALESCE(p.show_presence_to_friends, true) AS shows_presence
+FROM friends f
+JOIN users u ON u.id = CASE WHEN f.user_id = @me THEN f.friend_id ELSE f.user_id END AND u.deleted_at IS NULL
+LEFT JOIN user_preferences p ON p.user_id = u.id AND p.deleted_at IS NULL
+LEFT JOIN LATERAL (
+	SELECT COUNT(*) AS count
+	FROM friends g
+	JOIN friends h ON h.status = @accepted AND h.deleted_at IS NULL
+		AND ((h.user_id = @me AND h.friend_id = CASE WHEN g.user_id = u.id THEN g.friend_id ELSE g.user_id END)
+			OR (h.friend_id = @me AND h.user_id = CASE WHEN g.user_id = u.id THEN g.friend_id ELSE g.user_id END))
+	WHERE (g.user_id = u.id OR g.friend_id = u.id) AND g.status = @accepted AND g.deleted_at IS NULL
+) mutual ON true
+LEFT JOIN LATERAL (
+	SELECT s.id AS session_id, s.name AS session_name, GREATEST(a.joined_at, b.joined_at) AS met_at
+	FROM user_sessions a
+	JOIN user_sessions b ON b.session_id = a.session_id AND b.user_id = u.id AND b.deleted_at IS NULL
+	JOIN sessions s ON s.id = a.session_id
+	WHERE a.user_id = @me AND a.deleted_at IS NULL
+		AND GREATEST(a.joined_at, b.joined_at) < LEAST(COALESCE(NULLIF(a.left_at, 0), @now), COALESCE(NULLIF(b.left_at, 0), @now))
+	ORDER BY met_at DESC
+	LIMIT 1
+) met ON true
+WHERE (f.user_id = @me OR f.friend_id = @me) AND f.deleted_at IS NULL`
+
+// Extra conditions of the friend list filters
+var friendFilters = map[string]string{
+	"all":      " AND f.status IN (@pending, @accepted)",
+	"accepted": " AND f.status = @accepted",
+	"incoming": " AND f.status = @pending AND f.friend_id = @me",
+	"outgoing": " AND f.status = @pending AND f.user_id = @me",
+}
+
+type friendRow struct {
+	models.User
+	FriendshipID     uint
+	FriendshipStatus string
+	SenderID         uint
+	MutualFriends    int64
+	MetSessionID     *uint
+	MetSessionName   *string
+	MetAt            *int64
+	Favorite         bool
+	ShowsPresence    bool
+}
+
+// GetFriends lists the user's friends and open requests by name
+//
+// Query parameters:
+//
+//	filter  all (default), accepted, incoming or outgoing
+//	limit   page size, at most 100
+//	cursor  nextCursor of the previous page
+func GetFriends(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	filter := c.DefaultQuery("filter", "all")
+	query, ok := friendFilters[filter]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "filter must be all, accepted, incoming or outgoing"})
+		return
+	}
+	query = friendListQuery + query
+
+	limit := defaultFriendLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit"})
+			return
+		}
+		if n > maxFriendLimit {
+			n = maxFriendLimit
 		}
+		limit = n
+	}
 
-		var friend models.User
-		if err := inits.DB.First(&friend, friendID).Error; err != nil {
-			continue
+	args := map[string]interface{}{
+		"me":       userID,
+		"now":      time.Now().Unix(),
+		"pending":  models.FriendPending,
+		"accepted": models.FriendAccepted,
+		"limit":    limit + 1, // One extra row tells us whether there is another page
+	}
+	// Names are unique, the friendship ID only breaks ties between rows of the same user
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := decodeDirectoryCursor(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
 		}
+		query += " AND (u.name, f.id) > (@cursorName, @cursorID)"
+		args["cursorName"] = cursor.Value
+		args["cursorID"] = cursor.ID
+	}
+	query += " ORDER BY u.name, f.id LIMIT @limit"
 
-		thisUserNeedsToAccept := !conn.Accepted && conn.FriendID == uint(userIDUint)
+	var rows []friendRow
+	if err := inits.DB.Raw(query, args).Scan(&rows).Error; err != nil {
+		log.Printf("Failed to list friends: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching friendships"})
+		return
+	}
 
-		friendInfos = append(friendInfos, FriendInfo{
-			User:                 friend,
-			Accepted:             conn.Accepted,
-			ThisUserNeedToAccept: thisUserNeedsToAccept,
-		})
+	nextCursor := ""
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		nextCursor = encodeDirectoryCursor(directoryCursor{Value: last.Name, ID: last.FriendshipID})
+	}
+
+	// Group memberships of the whole page in one query
+	friendIDs := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		friendIDs = append(friendIDs, row.ID)
+	}
+	var memberships []models.ContactGroupMember
+	if len(friendIDs) > 0 {
+		inits.DB.Joins("JOIN contact_groups ON contact_groups.id = contact_group_members.group_id").
+			Where("contact_groups.user_id = ? AND contact_group_members.friend_id IN ?", userID, friendIDs).
+			Find(&memberships)
+	}
+	groups := map[uint][]uint{}
+	for _, member := range memberships {
+		groups[member.FriendID] = append(groups[member.FriendID], member.GroupID)
+	}
+
+	type LastMet struct {
+		SessionID uint      `json:"sessionId"`
+		Session   string    `json:"session"`
+		At        time.Time `json:"at"`
+	}
+	type FriendInfo struct {
+		User                 models.PublicUser `json:"user"`
+		Accepted             bool              `json:"accepted"`
+		ThisUserNeedToAccept bool              `json:"thisUserNeedToAccept"`
+		Presence             *userhub.Presence `json:"presence,omitempty"` // Only for accepted friends
+		Favorite             bool              `json:"favorite"`
+		GroupIDs             []uint            `json:"groupIds"`
+		MutualFriends        int64             `json:"mutualFriends"`
+		LastMet              *LastMet          `json:"lastMet,omitempty"` // Latest session both were in at once
+	}
+
+	friendInfos := make([]FriendInfo, 0, len(rows))
+	for _, row := range rows {
+		accepted := row.FriendshipStatus == models.FriendAccepted
+		info := FriendInfo{
+			User:                 row.User.Public(),
+			Accepted:             accepted,
+			ThisUserNeedToAccept: !accepted && row.SenderID != userID,
+			Favorite:             row.Favorite,
+			GroupIDs:             groups[row.ID],
+			MutualFriends:        row.MutualFriends,
+		}
+		if info.GroupIDs == nil {
+			info.GroupIDs = []uint{}
+		}
+		if accepted {
+			presence := userhub.VisiblePresence(row.ID, row.ShowsPresence)
+			info.Presence = &presence
+		}
+		if row.MetSessionID != nil && row.MetAt != nil {
+			info.LastMet = &LastMet{SessionID: *row.MetSessionID, At: time.Unix(*row.MetAt, 0)}
+			if row.MetSessionName != nil {
+				info.LastMet.Session = *row.MetSessionName
+			}
+		}
+		friendInfos = append(friendInfos, info)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"friends": friendInfos})
+	c.JSON(http.StatusOK, gin.H{"friends": friendInfos, "nextCursor": nextCursor})
 }
@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// One row of a user import and everything wrong with it
+type importRow struct {
+	Line     int      `json:"line"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles"`
+	Errors   []string `json:"errors,omitempty"`
+	Password string   `json:"temporaryPassword,omitempty"` // Only in the response of a real import
+}
+
+// Reads the CSV from a multipart "file" field or from the raw body
+func importReader(c *gin.Context) (io.ReadCloser, error) {
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, _, err := c.Request.FormFile("file")
+		if err != nil {
+			return nil, errors.New("missing CSV file")
+		}
+		return file, nil
+	}
+	return c.Request.Body, nil
+}
+
+// Parses the import CSV, which needs a header with name and optionally email and role
+func parseImport(r io.Reader) ([]*importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("the CSV is empty or invalid")
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("the CSV header needs a name column")
+	}
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	maxRows := viper.GetInt("import.maxRows")
+	var rows []*importRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(rows) == maxRows {
+			return nil, fmt.Errorf("at most %d users can be imported at once", maxRows)
+		}
+
+		row := &importRow{Line: line, Name: field(record, "name"), Email: field(record, "email")}
+		// Several roles are separated by semicolons, none means the signup defaults
+		for _, role := range strings.Split(field(record, "role"), ";") {
+			if role = strings.TrimSpace(role); role != "" {
+				row.Roles = append(row.Roles, role)
+			}
+		}
+		if len(row.Roles) == 0 {
+			row.Roles = viper.GetStringSlice("rbac.defaultRoles")
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("the CSV has no users")
+	}
+	return rows, nil
+}
+
+// Checks every row against the database and the other rows, returns whether all are valid
+func validateImport(rows []*importRow) bool {
+	var roles []models.Role
+	inits.DB.Find(&roles)
+	knownRoles := map[string]bool{}
+	for _, role := range roles {
+		knownRoles[role.Name] = true
+	}
+
+	seenNames := map[string]int{}
+	seenEmails := map[string]int{}
+	valid := true
+	for _, row := range rows {
+		if len(row.Name) < 3 {
+			row.Errors = append(row.Errors, "name must be at least 3 characters long")
+		} else {
+			// Names and emails are unique across deactivated users too
+			var count int64
+			inits.DB.Unscoped().Model(&models.User{}).Where("name = ?", row.Name).Count(&count)
+			if count > 0 {
+				row.Errors = append(row.Errors, "name is already taken")
+			}
+			if first, ok := seenNames[row.Name]; ok {
+				row.Errors = append(row.Errors, fmt.Sprintf("name repeats line %d", first))
+			} else {
+				seenNames[row.Name] = row.Line
+			}
+		}
+
+		if row.Email != "" {
+			email, err := normalizeEmail(row.Email)
+			if err != nil {
+				row.Errors = append(row.Errors, "invalid email address")
+			} else {
+				row.Email = email
+				var count int64
+				inits.DB.Unscoped().Model(&models.User{}).Where("email = ?", email).Count(&count)
+				if count > 0 {
+					row.Errors = append(row.Errors, "email address is already in use")
+				}
+				if first, ok := seenEmails[email]; ok {
+					row.Errors = append(row.Errors, fmt.Sprintf("email repeats line %d", first))
+				} else {
+					seenEmails[email] = row.Line
+				}
+			}
+		}
+
+		for _, role := range row.Roles {
+			if !knownRoles[role] {
+				row.Errors = append(row.Errors, fmt.Sprintf("unknown role %q", role))
+			}
+		}
+
+		if len(row.Errors) > 0 {
+			valid = false
+		}
+	}
+	return valid
+}
+
+// Creates every user of the import, or none of them
+func createImportedUsers(rows []*importRow) error {
+	// Hashing is slow on purpose, so do it before holding the transaction open
+	hashes := make([][]byte, len(rows))
+	for i, row := range rows {
+		password, err := randomToken(12)
+		if err != nil {
+			return err
+		}
+		hash, err := utils.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		row.Password = password
+		hashes[i] = hash
+	}
+
+	return inits.DB.Transaction(func(tx *gorm.DB) error {
+		for i, row := range rows {
+			var roles []models.Role
+			if err := tx.Where("name IN ?", row.Roles).Find(&roles).Error; err != nil {
+				return err
+			}
+			manager := false
+			for _, role := range roles {
+				manager = manager || role.Name == models.RoleAdmin
+			}
+
+			user := models.User{
+				Name:               row.Name,
+				Password:           hashes[i],
+				Email:              row.Email,
+				Manager:            manager,
+				MustChangePassword: true,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("line %d: %w", row.Line, err)
+			}
+			if err := tx.Model(&user).Association("Roles").Append(roles); err != nil {
+				return fmt.Errorf("line %d: %w", row.Line, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ImportUsers creates accounts from a CSV with the columns name, email and role
+//
+// With dryRun=true nothing is created and the response lists the problems of every row.
+// A real import creates all users or, if any row is invalid, none. The temporary
+// passwords are only ever shown in this response and must be changed on first login.
+func ImportUsers(c *gin.Context) {
+	dryRun := c.Query("dryRun") == "true"
+
+	body, err := importReader(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	rows, err := parseImport(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	valid := validateImport(rows)
+	if dryRun || !valid {
+		status := http.StatusOK
+		if !valid && !dryRun {
+			status = http.StatusUnprocessableEntity
+		}
+		c.JSON(status, gin.H{"dryRun": dryRun, "valid": valid, "rows": rows})
+		return
+	}
+
+	if err := createImportedUsers(rows); err != nil {
+		log.Printf("User import failed: %v", err)
+		c.JSON(http.StatusConflict, gin.H{"message": "Import failed, no users were created"})
+		return
+	}
+
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row.Name)
+	}
+	Audit(c, "user.import", "user", 0, "", nil, gin.H{"users": names})
+
+	c.JSON(http.StatusCreated, gin.H{"dryRun": false, "valid": true, "rows": rows})
+}
+
+// MustChangePassword reports whether the user still has to replace a temporary password
+func MustChangePassword(userID string) bool {
+	var user models.User
+	if err := inits.DB.Select("must_change_password").Where("id = ?", userID).First(&user).Error; err != nil {
+		return false
+	}
+	return user.MustChangePassword
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const ingestAudience = "ingest"
+
+// Lifetime of an ingest token, it only has to last until the media socket is open
+func ingestTokenTTL() time.Duration {
+	return time.Duration(viper.GetInt("ingest.tokenSeconds")) * time.Second
+}
+
+// CreateIngestToken issues a short-lived token that lets the user stream media into their current session
+func CreateIngestToken(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	sessionID, _, err := GetSessionByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You are not in an active session"})
+		return
+	}
+
+	expiresAt := time.Now().Add(ingestTokenTTL())
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": strconv.Itoa(int(userID)),
+		"aud": ingestAudience,
+		"sid": strconv.Itoa(int(sessionID)),
+		"exp": expiresAt.Unix(),
+	}).SignedString([]byte(viper.GetString("secret")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create ingest token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "sessionID": sessionID, "expiresAt": expiresAt})
+}
+
+// ParseIngestToken validates an ingest token and returns the user and session it was issued for.
+// The user must still be in that session, leaving it makes the token useless.
+func ParseIngestToken(tokenString string) (uint, uint, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(viper.GetString("secret")), nil
+	})
+	if err != nil || !token.Valid {
+		return 0, 0, errors.New("invalid or expired ingest token")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyAudience(ingestAudience, true) {
+		return 0, 0, errors.New("not an ingest token")
+	}
+	issuer, _ := claims["iss"].(string)
+	session, _ := claims["sid"].(string)
+	userID, err := strconv.ParseUint(issuer, 10, 32)
+	if err != nil {
+		return 0, 0, errors.New("invalid ingest token")
+	}
+	sessionID, err := strconv.ParseUint(session, 10, 32)
+	if err != nil {
+		return 0, 0, errors.New("invalid ingest token")
+	}
+
+	var count int64
+	inits.DB.Model(&models.UserSession{}).
+		Joins("JOIN sessions ON sessions.id = user_sessions.session_id AND sessions.deleted_at IS NULL").
+		Where("user_sessions.user_id = ? AND user_sessions.session_id = ? AND user_sessions.left_at IS NULL", userID, sessionID).
+		Where("sessions.status <> ?", "ended").
+		Count(&count)
+	if count == 0 {
+		return 0, 0, errors.New("the user is no longer in this session")
+	}
+
+	return uint(userID), uint(sessionID), nil
+}
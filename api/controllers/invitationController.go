@@ -0,0 +1,324 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/userhub"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most users invited in one call
+const maxInvitesPerRequest = 100
+
+// Resolves the names of users to invite, blocked users in either direction are rejected like unknown ones
+func inviteesByName(hostID uint, names []string) ([]uint, error) {
+	if len(names) > maxInvitesPerRequest {
+		return nil, fmt.Errorf("at most %d users can be invited at once", maxInvitesPerRequest)
+	}
+
+	ids := make([]uint, 0, len(names))
+	for _, name := range names {
+		var user models.User
+		if err := inits.DB.Where("name = ?", name).First(&user).Error; err != nil || IsBlocked(hostID, user.ID) {
+			return nil, fmt.Errorf("user %q not found", name)
+		}
+		if user.ID != hostID {
+			ids = append(ids, user.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Creates or renews an invitation for each user and notifies them, returns the invited names
+func inviteToSession(session models.Session, hostID uint, userIDs []uint) []string {
+	invited := []string{}
+	if len(userIDs) == 0 {
+		return invited
+	}
+
+	var host models.User
+	inits.DB.First(&host, hostID)
+	seen := map[uint]bool{}
+	for _, id := range userIDs {
+		if seen[id] || id == hostID || IsBlocked(hostID, id) {
+			continue
+		}
+		seen[id] = true
+
+		var user models.User
+		if err := inits.DB.First(&user, id).Error; err != nil {
+			continue
+		}
+
+		// Someone who declined or was invited before gets a fresh pending invitation
+		invitation := models.SessionInvitation{SessionID: session.ID, InviteeID: user.ID}
+		inits.DB.Where(invitation).First(&invitation)
+		if invitation.Status == models.InviteAccepted {
+			invited = append(invited, user.Name)
+			continue
+		}
+		invitation.InviterID = hostID
+		invitation.Status = models.InvitePending
+		invitation.RespondedAt = nil
+		if err := inits.DB.Save(&invitation).Error; err != nil {
+			log.Printf("Failed to invite %s to session %d: %v", user.Name, session.ID, err)
+			continue
+		}
+
+		userhub.NotifyInvitation(invitation, &host, session)
+		invited = append(invited, user.Name)
+	}
+	return invited
+}
+
+func findInvitation(sessionID, userID uint) (models.SessionInvitation, error) {
+	var invitation models.SessionInvitation
+	err := inits.DB.Where("session_id = ? AND invitee_id = ?", sessionID, userID).First(&invitation).Error
+	return invitation, err
+}
+
+// Records the invitee's answer and tells the inviter
+func respondToInvitation(invitation *models.SessionInvitation, status string) {
+	now := time.Now()
+	invitation.Status = status
+	invitation.RespondedAt = &now
+	if err := inits.DB.Model(invitation).Updates(map[string]interface{}{"status": status, "responded_at": now}).Error; err != nil {
+		log.Printf("Failed to update invitation %d: %v", invitation.ID, err)
+		return
+	}
+
+	var invitee models.User
+	var session models.Session
+	inits.DB.First(&invitee, invitation.InviteeID)
+	inits.DB.First(&session, invitation.SessionID)
+	notificationType := models.NotifyInviteAccepted
+	if status == models.InviteDeclined {
+		notificationType = models.NotifyInviteDeclined
+	}
+	userhub.NotifySession(invitation.InviterID, notificationType, &invitee, session)
+
+	// The invite itself needs no more attention
+	if err := inits.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND invite_id = ? AND read_at IS NULL", invitation.InviteeID, invitation.ID).
+		Update("read_at", now).Error; err == nil {
+		userhub.PushUnreadCount(invitation.InviteeID)
+	}
+}
+
+// Loads a session by the name in the URL and checks the caller hosts it, responding itself on failure
+func hostedSession(c *gin.Context, userID uint) (models.Session, bool) {
+	var session models.Session
+	if err := inits.DB.Where("name = ?", c.Param("id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Session not found"})
+		return session, false
+	}
+	if session.HostID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only the host can manage this session"})
+		return session, false
+	}
+	return session, true
+}
+
+type invitationResponse struct {
+	ID          uint              `json:"id"`
+	SessionID   uint              `json:"sessionId"`
+	Session     string            `json:"session"`
+	Inviter     models.PublicUser `json:"inviter"`
+	Invitee     models.PublicUser `json:"invitee"`
+	Status      string            `json:"status"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	RespondedAt *time.Time        `json:"respondedAt,omitempty"`
+}
+
+// Builds the responses of several invitations, loading their sessions and users in one query each
+func invitationResponses(invitations []models.SessionInvitation) []invitationResponse {
+	sessions := map[uint]models.Session{}
+	users := map[uint]models.User{}
+	if len(invitations) > 0 {
+		sessionIDs := make([]uint, 0, len(invitations))
+		userIDs := make([]uint, 0, 2*len(invitations))
+		for _, invitation := range invitations {
+			sessionIDs = append(sessionIDs, invitation.SessionID)
+			userIDs = append(userIDs, invitation.InviterID, invitation.InviteeID)
+		}
+
+		var foundSessions []models.Session
+		inits.DB.Unscoped().Where("id IN ?", sessionIDs).Find(&foundSessions)
+		for _, session := range foundSessions {
+			sessions[session.ID] = session
+		}
+		var foundUsers []models.User
+		inits.DB.Unscoped().Where("id IN ?", userIDs).Find(&foundUsers)
+		for _, user := range foundUsers {
+			users[user.ID] = user
+		}
+	}
+
+	responses := make([]invitationResponse, 0, len(invitations))
+	for _, invitation := range invitations {
+		session := sessions[invitation.SessionID]
+		inviter := users[invitation.InviterID]
+		invitee := users[invitation.InviteeID]
+		responses = append(responses, invitationResponse{
+			ID:          invitation.ID,
+			SessionID:   session.ID,
+			Session:     session.Name,
+			Inviter:     inviter.Public(),
+			Invitee:     invitee.Public(),
+			Status:      invitation.Status,
+			CreatedAt:   invitation.CreatedAt,
+			RespondedAt: invitation.RespondedAt,
+		})
+	}
+	return responses
+}
+
+// InviteToSession invites users by name to a session the authenticated user hosts
+func InviteToSession(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	session, ok := hostedSession(c, userID)
+	if !ok {
+		return
+	}
+	if session.Status == "ended" {
+		c.JSON(http.StatusGone, gin.H{"message": "The session has ended"})
+		return
+	}
+
+	var input struct {
+		Names []string `json:"names" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	ids, err := inviteesByName(userID, input.Names)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invited": inviteToSession(session, userID, ids)})
+}
+
+// ListSessionInvitations shows the host every invitation of their session and its status
+func ListSessionInvitations(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	session, ok := hostedSession(c, userID)
+	if !ok {
+		return
+	}
+
+	var invitations []models.SessionInvitation
+	if err := inits.DB.Where("session_id = ?", session.ID).Order("id").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitationResponses(invitations)})
+}
+
+// MyInvitations lists the pending invitations of the authenticated user
+func MyInvitations(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var invitations []models.SessionInvitation
+	if err := inits.DB.Where("invitee_id = ? AND status = ?", userID, models.InvitePending).Order("id DESC").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitationResponses(invitations)})
+}
+
+// Loads a pending invitation of the caller from the :id parameter, responding itself on failure
+func ownPendingInvitation(c *gin.Context, userID uint) (models.SessionInvitation, models.Session, bool) {
+	var invitation models.SessionInvitation
+	var session models.Session
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid invitation ID"})
+		return invitation, session, false
+	}
+	if err := inits.DB.Where("id = ? AND invitee_id = ?", id, userID).First(&invitation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Invitation not found"})
+		return invitation, session, false
+	}
+	if invitation.Status != models.InvitePending {
+		c.JSON(http.StatusConflict, gin.H{"message": "The invitation is already " + invitation.Status})
+		return invitation, session, false
+	}
+
+	// Normally expired when the session ends, this catches a session that ended without it
+	if err := inits.DB.First(&session, invitation.SessionID).Error; err != nil || session.Status == "ended" {
+		inits.DB.Model(&invitation).Update("status", models.InviteExpired)
+		c.JSON(http.StatusGone, gin.H{"message": "The session has ended"})
+		return invitation, session, false
+	}
+	return invitation, session, true
+}
+
+// AcceptInvitation accepts an invitation and joins its session
+func AcceptInvitation(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	invitation, session, ok := ownPendingInvitation(c, userID)
+	if !ok {
+		return
+	}
+	if IsBannedFromSession(session.ID, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You were removed from this meeting"})
+		return
+	}
+	if session.Locked {
+		c.JSON(http.StatusForbidden, gin.H{"message": "The meeting is locked"})
+		return
+	}
+
+	if err := CreateUserSession(userID, session.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	respondToInvitation(&invitation, models.InviteAccepted)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully joined the session", "session_id": session.ID, "session": session.Name})
+}
+
+// DeclineInvitation turns an invitation down, the host can invite again later
+func DeclineInvitation(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	invitation, _, ok := ownPendingInvitation(c, userID)
+	if !ok {
+		return
+	}
+
+	respondToInvitation(&invitation, models.InviteDeclined)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined"})
+}
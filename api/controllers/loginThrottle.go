@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Names are tracked whether or not the account exists, so a lockout does not reveal which names are real
+func accountThrottleKey(name string) string {
+	return "name:" + strings.ToLower(name)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Returns how long the key is still locked, or zero if it is not
+func loginLockRemaining(key string) time.Duration {
+	var throttle models.LoginThrottle
+	if err := inits.DB.Where("key = ?", key).First(&throttle).Error; err != nil {
+		return 0
+	}
+	if throttle.LockedUntil == nil {
+		return 0
+	}
+	return max(time.Until(*throttle.LockedUntil), 0)
+}
+
+// Counts a failed attempt and locks the key with exponential backoff once the limit is passed
+func recordLoginFailure(key string, maxAttempts int) error {
+	return inits.DB.Transaction(func(tx *gorm.DB) error {
+		var throttle models.LoginThrottle
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&throttle).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			throttle = models.LoginThrottle{Key: key}
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		// Failures older than the window are forgotten
+		window := time.Duration(viper.GetInt("login.failureWindowMinutes")) * time.Minute
+		if now.Sub(throttle.LastFailureAt) > window {
+			throttle.Failures = 0
+		}
+
+		throttle.Failures++
+		throttle.LastFailureAt = now
+
+		if throttle.Failures >= maxAttempts {
+			// 1x, 2x, 4x ... the base lockout, capped at the maximum
+			base := time.Duration(viper.GetInt("login.baseLockoutSeconds")) * time.Second
+			maxLockout := time.Duration(viper.GetInt("login.maxLockoutMinutes")) * time.Minute
+			lockout := time.Duration(float64(base) * math.Pow(2, float64(throttle.Failures-maxAttempts)))
+			if lockout <= 0 || lockout > maxLockout {
+				lockout = maxLockout
+			}
+			lockedUntil := now.Add(lockout)
+			throttle.LockedUntil = &lockedUntil
+		}
+
+		return tx.Save(&throttle).Error
+	})
+}
+
+// Forgets the failed attempts of a key
+func clearLoginFailures(key string) error {
+	return inits.DB.Unscoped().Where("key = ?", key).Delete(&models.LoginThrottle{}).Error
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// Burns the same time as a real password check so unknown names cannot be told apart by timing
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = utils.HashPassword("dummy-password")
+	})
+	utils.CheckPassword(dummyHash, password)
+}
+
+// Checks the password of a signed-in user before a sensitive change, responding itself on failure.
+// Wrong passwords count towards the login lockout, so a stolen token cannot be used to guess it.
+func checkPasswordThrottled(c *gin.Context, user models.User, password, wrongMessage string) bool {
+	accountKey := accountThrottleKey(user.Name)
+	if remaining := loginLockRemaining(accountKey); remaining > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many failed attempts, try again later"})
+		return false
+	}
+	if err := utils.CheckPassword(user.Password, password); err != nil {
+		if err := recordLoginFailure(accountKey, viper.GetInt("login.maxAttempts")); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"message": wrongMessage})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,329 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/pipelines"
+	"yuval/websocket2"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errNotParticipant = errors.New("this user is not in the meeting")
+	errCannotModerate = errors.New("you cannot do this to the host or another co-host")
+	errSessionEnded   = errors.New("the meeting has already ended")
+)
+
+// Maps the errors of the moderation actions to a status code
+func moderationStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotModerator), errors.Is(err, errCannotModerate):
+		return http.StatusForbidden
+	case errors.Is(err, errNotParticipant), errors.Is(err, errNotWaiting):
+		return http.StatusNotFound
+	case errors.Is(err, errSessionEnded):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// IsBannedFromSession reports whether the user was removed from the session with a ban
+func IsBannedFromSession(sessionID, userID uint) bool {
+	var count int64
+	inits.DB.Model(&models.SessionBan{}).Where("session_id = ? AND user_id = ?", sessionID, userID).Count(&count)
+	return count > 0
+}
+
+// Checks a moderator may act on a participant currently in the meeting. Only the host
+// may act on co-hosts, and nobody on the host.
+func moderatedParticipant(session models.Session, moderatorID uint, name string) (models.User, error) {
+	var user models.User
+	if !IsSessionModerator(session, moderatorID) {
+		return user, errNotModerator
+	}
+	if err := inits.DB.Where("name = ?", name).First(&user).Error; err != nil {
+		return user, errNotParticipant
+	}
+	if user.ID == session.HostID || (moderatorID != session.HostID && IsSessionModerator(session, user.ID)) {
+		return user, errCannotModerate
+	}
+
+	var count int64
+	inits.DB.Model(&models.UserSession{}).Where("session_id = ? AND user_id = ? AND left_at IS NULL", session.ID, user.ID).Count(&count)
+	if count == 0 {
+		return user, errNotParticipant
+	}
+	return user, nil
+}
+
+// Asks a participant's client to turn their microphone or camera off. Media is sent
+// from the browser, so the client enforces it and only the participant can turn it back on.
+func muteParticipant(session models.Session, moderatorID uint, name string, kind string) error {
+	user, err := moderatedParticipant(session, moderatorID, name)
+	if err != nil {
+		return err
+	}
+	websocket2.SendToSessionUsers(session.ID, []uint{user.ID}, gin.H{"type": kind, "by": moderatorID})
+	return nil
+}
+
+// Takes a participant out of the meeting, with ban set they cannot join it again
+func removeParticipant(session models.Session, moderatorID uint, name string, ban bool) error {
+	user, err := moderatedParticipant(session, moderatorID, name)
+	if err != nil {
+		return err
+	}
+
+	if ban {
+		sessionBan := models.SessionBan{SessionID: session.ID, UserID: user.ID}
+		if err := inits.DB.Where(sessionBan).Attrs(models.SessionBan{BannedBy: moderatorID}).FirstOrCreate(&sessionBan).Error; err != nil {
+			return fmt.Errorf("failed to ban the user: %v", err)
+		}
+	}
+	if err := inits.DB.Model(&models.UserSession{}).Where("session_id = ? AND user_id = ? AND left_at IS NULL", session.ID, user.ID).
+		Update("left_at", uint(time.Now().Unix())).Error; err != nil {
+		return fmt.Errorf("failed to remove the user: %v", err)
+	}
+	// Coming back without a ban means going through the waiting room again
+	inits.DB.Unscoped().Where("session_id = ? AND user_id = ?", session.ID, user.ID).Delete(&models.WaitingRoomEntry{})
+
+	websocket2.DisconnectUser(session.ID, user.ID, gin.H{"type": "removed", "banned": ban})
+	pipelines.StopUser(session.ID, user.ID)
+	websocket2.BroadcastMessage(session.ID, fmt.Sprintf("User %d has left the session %d", user.ID, session.ID))
+	return nil
+}
+
+// Locks or unlocks a session for everyone but its moderators
+func lockSession(session models.Session, moderatorID uint, locked bool) error {
+	if !IsSessionModerator(session, moderatorID) {
+		return errNotModerator
+	}
+	if err := inits.DB.Model(&session).Update("locked", locked).Error; err != nil {
+		return fmt.Errorf("failed to lock the session: %v", err)
+	}
+	websocket2.SendToSessionUsers(session.ID, sessionModerators(session), gin.H{"type": "locked", "locked": locked})
+	return nil
+}
+
+// Ends a meeting for everyone in it. Moderators can end their own meetings, and users
+// with the sessions.end_any permission any meeting.
+func endSessionForAll(session models.Session, userID uint) error {
+	if !IsSessionModerator(session, userID) && !UserHasPermission(userID, models.PermSessionsEndAny) {
+		return errNotModerator
+	}
+	// Claiming the end first keeps the leaving connections from ending it a second time
+	if !websocket2.MarkSessionEnded(session.ID, "ended") {
+		return errSessionEnded
+	}
+
+	if err := inits.DB.Model(&models.UserSession{}).Where("session_id = ? AND left_at IS NULL", session.ID).
+		Update("left_at", uint(time.Now().Unix())).Error; err != nil {
+		return fmt.Errorf("failed to end the session: %v", err)
+	}
+	websocket2.CloseSession(session.ID, gin.H{"type": "session_ended", "by": userID})
+	go websocket2.HandleSessionEnd(session.ID)
+	return nil
+}
+
+// Loads the session named in the URL, responding itself on failure
+func sessionFromParam(c *gin.Context) (models.Session, uint, bool) {
+	var session models.Session
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return session, 0, false
+	}
+	if err := inits.DB.Where("name = ?", c.Param("id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Session not found"})
+		return session, 0, false
+	}
+	return session, userID, true
+}
+
+func respondModeration(c *gin.Context, err error, message string) {
+	if err != nil {
+		c.JSON(moderationStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// MuteParticipant asks a participant's client to mute their microphone
+func MuteParticipant(c *gin.Context) {
+	session, userID, ok := sessionFromParam(c)
+	if !ok {
+		return
+	}
+	respondModeration(c, muteParticipant(session, userID, c.Param("name"), "mute"), "Participant muted")
+}
+
+// StopParticipantVideo asks a participant's client to turn their camera off
+func StopParticipantVideo(c *gin.Context) {
+	session, userID, ok := sessionFromParam(c)
+	if !ok {
+		return
+	}
+	respondModeration(c, muteParticipant(session, userID, c.Param("name"), "video_off"), "Participant video stopped")
+}
+
+// RemoveParticipant takes a participant out of the meeting, optionally banning them from it
+func RemoveParticipant(c *gin.Context) {
+	var input struct {
+		Ban bool `json:"ban"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+			return
+		}
+	}
+
+	session, userID, ok := sessionFromParam(c)
+	if !ok {
+		return
+	}
+	respondModeration(c, removeParticipant(session, userID, c.Param("name"), input.Ban), "Participant removed")
+}
+
+// LiftSessionBan lets a banned user join the session again
+func LiftSessionBan(c *gin.Context) {
+	session, userID, ok := sessionFromParam(c)
+	if !ok {
+		return
+	}
+	if !IsSessionModerator(session, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": errNotModerator.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Unscoped().Where("name = ?", c.Param("name")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	result := inits.DB.Unscoped().Where("session_id = ? AND user_id = ?", session.ID, user.ID).Delete(&models.SessionBan{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to lift the ban"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "This user is not banned"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Ban lifted"})
+}
+
+// LockSession locks or unlocks a session for new participants
+func LockSession(c *gin.Context) {
+	var input struct {
+		Locked *bool `json:"locked" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	session, userID, ok := sessionFromParam(c)
+	if !ok {
+		return
+	}
+	message := "Session unlocked"
+	if *input.Locked {
+		message = "Session locked"
+	}
+	respondModeration(c, lockSession(session, userID, *input.Locked), message)
+}
+
+// EndSessionForAll ends a meeting for everyone in it
+func EndSessionForAll(c *gin.Context) {
+	session, userID, ok := sessionFromParam(c)
+	if !ok {
+		return
+	}
+
+	err := endSessionForAll(session, userID)
+	if err == nil && !IsSessionModerator(session, userID) {
+		Audit(c, "session.end", "session", session.ID, session.Name, nil, nil)
+	}
+	respondModeration(c, err, "Session ended")
+}
+
+// Builds a websocket command that acts on the sender's session
+func moderationCommand(run func(session models.Session, userID uint, payload json.RawMessage) error) websocket2.CommandHandler {
+	return func(userID, sessionID uint, payload json.RawMessage) error {
+		var session models.Session
+		if err := inits.DB.First(&session, sessionID).Error; err != nil {
+			return errors.New("session not found")
+		}
+		return run(session, userID, payload)
+	}
+}
+
+// Reads the participant name of a websocket command
+func commandName(payload json.RawMessage) (string, error) {
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(payload, &input); err != nil || input.Name == "" {
+		return "", errors.New("a name is required")
+	}
+	return input.Name, nil
+}
+
+// MuteCommand is the websocket command {"type": "mute", "name": "..."}
+var MuteCommand = moderationCommand(func(session models.Session, userID uint, payload json.RawMessage) error {
+	name, err := commandName(payload)
+	if err != nil {
+		return err
+	}
+	return muteParticipant(session, userID, name, "mute")
+})
+
+// VideoOffCommand is the websocket command {"type": "video_off", "name": "..."}
+var VideoOffCommand = moderationCommand(func(session models.Session, userID uint, payload json.RawMessage) error {
+	name, err := commandName(payload)
+	if err != nil {
+		return err
+	}
+	return muteParticipant(session, userID, name, "video_off")
+})
+
+// RemoveCommand is the websocket command {"type": "remove", "name": "...", "ban": false}
+var RemoveCommand = moderationCommand(func(session models.Session, userID uint, payload json.RawMessage) error {
+	var input struct {
+		Name string `json:"name"`
+		Ban  bool   `json:"ban"`
+	}
+	if err := json.Unmarshal(payload, &input); err != nil || input.Name == "" {
+		return errors.New("a name is required")
+	}
+	return removeParticipant(session, userID, input.Name, input.Ban)
+})
+
+// LockCommand is the websocket command {"type": "lock", "locked": true}
+var LockCommand = moderationCommand(func(session models.Session, userID uint, payload json.RawMessage) error {
+	var input struct {
+		Locked bool `json:"locked"`
+	}
+	if err := json.Unmarshal(payload, &input); err != nil {
+		return errors.New("invalid lock command")
+	}
+	return lockSession(session, userID, input.Locked)
+})
+
+// EndCommand is the websocket command {"type": "end"}
+var EndCommand = moderationCommand(func(session models.Session, userID uint, payload json.RawMessage) error {
+	err := endSessionForAll(session, userID)
+	if err == nil && !IsSessionModerator(session, userID) {
+		AuditAs(userID, "session.end", "session", session.ID, session.Name, nil, nil)
+	}
+	return err
+})
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/userhub"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+// Deletes read notifications older than notifications.retentionDays
+func pruneOldNotifications() {
+	cutoff := time.Now().AddDate(0, 0, -viper.GetInt("notifications.retentionDays"))
+	if err := inits.DB.Unscoped().Where("read_at IS NOT NULL AND created_at < ?", cutoff).Delete(&models.Notification{}).Error; err != nil {
+		log.Printf("Failed to prune notifications: %v", err)
+	}
+}
+
+// ListNotifications returns the authenticated user's notifications, newest first
+//
+// Query parameters: unread=true for only unread ones, limit (at most 100) and
+// cursor, the nextCursor of the previous page.
+func ListNotifications(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	query := inits.DB.Where("user_id = ?", userID)
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+
+	limit := defaultNotificationLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit"})
+			return
+		}
+		if n > maxNotificationLimit {
+			n = maxNotificationLimit
+		}
+		limit = n
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		id, err := strconv.Atoi(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid cursor"})
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	var notifications []models.Notification
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&notifications).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching notifications"})
+		return
+	}
+
+	nextCursor := ""
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		nextCursor = strconv.Itoa(int(notifications[len(notifications)-1].ID))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications, "unread": userhub.UnreadCount(userID), "nextCursor": nextCursor})
+}
+
+// UnreadNotificationCount returns the number for the unread badge
+func UnreadNotificationCount(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"unread": userhub.UnreadCount(userID)})
+}
+
+// MarkNotificationsRead marks the listed notifications, or all with {"all": true}, as read
+func MarkNotificationsRead(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var input struct {
+		IDs []uint `json:"ids"`
+		All bool   `json:"all"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (len(input.IDs) == 0 && !input.All) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Pass ids or all"})
+		return
+	}
+
+	query := inits.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	if !input.All {
+		query = query.Where("id IN ?", input.IDs)
+	}
+	if err := query.Update("read_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to mark notifications read"})
+		return
+	}
+
+	// Other tabs update their badge too
+	userhub.PushUnreadCount(userID)
+
+	c.JSON(http.StatusOK, gin.H{"unread": userhub.UnreadCount(userID)})
+}
+
+// Marks the recipient's friend request notification from sender as read once the request is gone
+func clearFriendRequestNotification(recipientID, senderID uint) {
+	result := inits.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND actor_id = ? AND type = ? AND read_at IS NULL", recipientID, senderID, models.NotifyFriendRequest).
+		Update("read_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Failed to clear friend request notification: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		userhub.PushUnreadCount(recipientID)
+	}
+}
@@ -0,0 +1,353 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/oidc"
+	"yuval/utils"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcStateCookie   = "OIDCState"
+	oidcStateAudience = "oidc"
+	oidcStateTTL      = 10 * time.Minute
+	reauthCookie      = "Reauth"
+	reauthAudience    = "reauth"
+	reauthTTL         = 5 * time.Minute
+)
+
+// Characters allowed in user names created from an external identity
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Errors of resolveExternalUser the frontend gets a specific code for
+var (
+	errIdentityLinkedElsewhere = errors.New("this identity is already linked to another account")
+	errNoLinkedAccount         = errors.New("no account is linked to this identity")
+)
+
+// Redirects the browser back to the frontend with a fixed error code, the details only go to the log
+func oidcFail(c *gin.Context, code string, err error) {
+	if err != nil {
+		log.Printf("OIDC %s: %v", code, err)
+	}
+	target := viper.GetString("oidc.failureRedirect") + "?error=" + url.QueryEscape(code)
+	c.Redirect(http.StatusFound, target)
+}
+
+// Sets a short-lived cookie proving the user just signed in again with their identity provider
+func setReauthCookie(c *gin.Context, userID uint) error {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Issuer:    strconv.Itoa(int(userID)),
+		Audience:  reauthAudience,
+		ExpiresAt: time.Now().Add(reauthTTL).Unix(),
+	}).SignedString([]byte(viper.GetString("secret")))
+	if err != nil {
+		return err
+	}
+	c.SetCookie(reauthCookie, signed, int(reauthTTL.Seconds()), "/users", "localhost", false, true)
+	return nil
+}
+
+// Whether the user re-authenticated with their identity provider in the last few minutes. Accounts
+// created through single sign-on have a password they never saw, this stands in for it.
+func recentlyReauthenticated(c *gin.Context, userID uint) bool {
+	cookie, err := c.Cookie(reauthCookie)
+	if err != nil {
+		return false
+	}
+	token, err := jwt.Parse(cookie, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(viper.GetString("secret")), nil
+	})
+	if err != nil || !token.Valid {
+		return false
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	issuer, _ := claims["iss"].(string)
+	return claims.VerifyAudience(reauthAudience, true) && issuer == strconv.Itoa(int(userID))
+}
+
+// OIDCLogin starts the authorization code flow with PKCE
+//
+// A signed-in user passing reauth=true only proves who they are again, for actions that
+// normally ask for the password.
+func OIDCLogin(c *gin.Context) {
+	if oidc.Default == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Single sign-on is not enabled"})
+		return
+	}
+
+	state, errState := randomToken(16)
+	nonce, errNonce := randomToken(16)
+	verifier, errVerifier := randomToken(32)
+	if errState != nil || errNonce != nil || errVerifier != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to start login"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"aud":      oidcStateAudience,
+		"exp":      time.Now().Add(oidcStateTTL).Unix(),
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}
+
+	// A signed-in user starting the flow links the identity to their own account
+	if userID, err := GetUserIDFromToken(c); err == nil {
+		if c.Query("reauth") == "true" {
+			claims["reauth"] = userID
+		} else {
+			claims["link"] = userID
+		}
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(viper.GetString("secret")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to start login"})
+		return
+	}
+
+	authURL, err := oidc.Default.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"message": "Identity provider is unavailable"})
+		return
+	}
+
+	c.SetCookie(oidcStateCookie, signed, int(oidcStateTTL.Seconds()), "/users/oidc", "localhost", false, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Reads and checks the state cookie set by OIDCLogin
+func parseOIDCState(c *gin.Context) (jwt.MapClaims, error) {
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil {
+		return nil, errors.New("login session expired")
+	}
+
+	token, err := jwt.Parse(cookie, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(viper.GetString("secret")), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("login session expired")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyAudience(oidcStateAudience, true) {
+		return nil, errors.New("invalid login session")
+	}
+	if state, _ := claims["state"].(string); state == "" || state != c.Query("state") {
+		return nil, errors.New("invalid login state")
+	}
+	return claims, nil
+}
+
+// Picks a free user name based on the identity's preferred name
+func uniqueUserName(tx *gorm.DB, claims *oidc.Claims) string {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	if base == "" {
+		base = claims.Name
+	}
+	base = invalidNameChars.ReplaceAllString(base, "")
+	if len(base) < 3 {
+		base = "user"
+	}
+
+	name := base
+	for i := 2; ; i++ {
+		var count int64
+		tx.Unscoped().Model(&models.User{}).Where("name = ?", name).Count(&count)
+		if count == 0 {
+			return name
+		}
+		name = base + strconv.Itoa(i)
+	}
+}
+
+// Finds the user of an external identity, linking or creating an account when needed
+func resolveExternalUser(claims *oidc.Claims, linkUserID string) (models.User, error) {
+	var user models.User
+	provider := oidc.Default.Issuer
+
+	err := inits.DB.Transaction(func(tx *gorm.DB) error {
+		var identity models.ExternalIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider, claims.Subject).First(&identity).Error
+		if err == nil {
+			if linkUserID != "" && linkUserID != strconv.Itoa(int(identity.UserID)) {
+				return errIdentityLinkedElsewhere
+			}
+			return tx.First(&user, identity.UserID).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := ""
+		if claims.EmailVerified {
+			email, _ = normalizeEmail(claims.Email)
+		}
+
+		switch {
+		case linkUserID != "":
+			// Explicit linking from a signed-in session
+			if err := tx.First(&user, linkUserID).Error; err != nil {
+				return err
+			}
+		case email != "" && tx.Where("email = ? AND email_verified = ?", email, true).First(&user).Error == nil:
+			// Only link by email when both sides verified the address, otherwise anyone could claim an account
+		case viper.GetBool("oidc.allowSignup"):
+			// Create the user just in time, with a random password they never see
+			randomPassword, err := randomToken(32)
+			if err != nil {
+				return err
+			}
+			password, err := utils.HashPassword(randomPassword)
+			if err != nil {
+				return err
+			}
+			user = models.User{
+				Name:     uniqueUserName(tx, claims),
+				Password: password,
+			}
+			if email != "" && !isEmailTaken(email, 0) {
+				user.Email = email
+				user.EmailVerified = true
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		default:
+			return errNoLinkedAccount
+		}
+
+		return tx.Create(&models.ExternalIdentity{
+			UserID:   user.ID,
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		}).Error
+	})
+	if err != nil {
+		return user, err
+	}
+
+	// New users get the same roles as a normal signup
+	var roleCount int64
+	inits.DB.Table("user_roles").Where("user_id = ?", user.ID).Count(&roleCount)
+	if roleCount == 0 {
+		if err := assignDefaultRoles(&user); err != nil {
+			log.Printf("Failed to assign default roles: %v", err)
+		}
+	}
+
+	return user, nil
+}
+
+// OIDCCallback finishes the flow, signs the user in and redirects to the frontend
+func OIDCCallback(c *gin.Context) {
+	if oidc.Default == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Single sign-on is not enabled"})
+		return
+	}
+
+	// The state cookie is single use
+	c.SetCookie(oidcStateCookie, "", -1, "/users/oidc", "localhost", false, true)
+
+	if providerErr := c.Query("error"); providerErr != "" {
+		oidcFail(c, "provider_error", errors.New(providerErr))
+		return
+	}
+
+	state, err := parseOIDCState(c)
+	if err != nil {
+		oidcFail(c, "session_expired", err)
+		return
+	}
+
+	verifier, _ := state["verifier"].(string)
+	nonce, _ := state["nonce"].(string)
+	linkUserID, _ := state["link"].(string)
+	reauthUserID, _ := state["reauth"].(string)
+
+	idToken, err := oidc.Default.Exchange(c.Query("code"), verifier)
+	if err != nil {
+		oidcFail(c, "login_failed", fmt.Errorf("code exchange failed: %w", err))
+		return
+	}
+
+	claims, err := oidc.Default.VerifyIDToken(idToken, nonce)
+	if err != nil {
+		oidcFail(c, "login_failed", fmt.Errorf("token verification failed: %w", err))
+		return
+	}
+
+	// Re-authentication neither signs in nor links, the identity must already belong to the user
+	if reauthUserID != "" {
+		var identity models.ExternalIdentity
+		if err := inits.DB.Where("provider = ? AND subject = ? AND user_id = ?", oidc.Default.Issuer, claims.Subject, reauthUserID).First(&identity).Error; err != nil {
+			oidcFail(c, "reauth_failed", fmt.Errorf("identity %s is not linked to user %s: %w", claims.Subject, reauthUserID, err))
+			return
+		}
+		if err := setReauthCookie(c, identity.UserID); err != nil {
+			oidcFail(c, "reauth_failed", err)
+			return
+		}
+		c.Redirect(http.StatusFound, viper.GetString("oidc.reauthRedirect"))
+		return
+	}
+
+	user, err := resolveExternalUser(claims, linkUserID)
+	if err != nil {
+		code := "login_failed"
+		switch {
+		case errors.Is(err, errIdentityLinkedElsewhere):
+			code = "identity_linked_elsewhere"
+		case errors.Is(err, errNoLinkedAccount):
+			code = "no_linked_account"
+		}
+		oidcFail(c, code, fmt.Errorf("login for %s failed: %w", claims.Subject, err))
+		return
+	}
+
+	// Users with 2FA still need their code, the frontend finishes the login through POST /users/login/2fa
+	if user.TOTPEnabled {
+		challenge, err := createTwoFactorChallenge(user)
+		if err != nil {
+			oidcFail(c, "login_failed", fmt.Errorf("creating 2FA challenge: %w", err))
+			return
+		}
+		// In the fragment so the challenge never reaches a server log
+		c.Redirect(http.StatusFound, viper.GetString("oidc.twoFactorRedirect")+"#challenge="+url.QueryEscape(challenge))
+		return
+	}
+
+	if err := IssueTokens(c, user); err != nil {
+		oidcFail(c, "login_failed", fmt.Errorf("creating token: %w", err))
+		return
+	}
+
+	c.Redirect(http.StatusFound, viper.GetString("oidc.successRedirect"))
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"yuval/userhub"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Longest a manual status may last before it has to be set again
+const maxManualStatusDuration = 7 * 24 * time.Hour
+
+// GetStatus returns the authenticated user's own presence
+func GetStatus(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"presence": userhub.PresenceOf(userID)})
+}
+
+// SetStatus sets a manual status, optionally ending after a number of minutes
+func SetStatus(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var input struct {
+		Status           string `json:"status" binding:"required"` // online, away or dnd
+		Message          string `json:"message"`
+		ExpiresInMinutes int    `json:"expiresInMinutes"` // 0 keeps the status until it is cleared
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	// In a meeting and offline follow from the connections, they cannot be set by hand
+	switch input.Status {
+	case userhub.StatusOnline, userhub.StatusAway, userhub.StatusDND:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "status must be online, away or dnd"})
+		return
+	}
+
+	message := strings.TrimSpace(input.Message)
+	if err := validateText("Message", message, 100, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	var expiresAt *time.Time
+	if input.ExpiresInMinutes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "expiresInMinutes must not be negative"})
+		return
+	}
+	if input.ExpiresInMinutes > 0 {
+		duration := time.Duration(input.ExpiresInMinutes) * time.Minute
+		if duration > maxManualStatusDuration {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "A status can last at most 7 days"})
+			return
+		}
+		t := time.Now().Add(duration)
+		expiresAt = &t
+	}
+
+	if err := userhub.SetManualStatus(userID, input.Status, message, expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to set status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"presence": userhub.PresenceOf(userID)})
+}
+
+// ClearStatus removes the manual status so presence follows activity again
+func ClearStatus(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := userhub.ClearManualStatus(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to clear status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"presence": userhub.PresenceOf(userID)})
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezone names must validate even where the system has no zoneinfo
+	"unicode"
+	"unicode/utf8"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/userhub"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BCP 47 language tag, loosely: a language with optional region, script or variant subtags
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Optional profile fields of UserUpdate, nil means unchanged and "" clears the field
+type profileInput struct {
+	DisplayName *string `json:"DisplayName"`
+	Bio         *string `json:"Bio"`
+	Timezone    *string `json:"Timezone"`
+	Locale      *string `json:"Locale"`
+	Pronouns    *string `json:"Pronouns"`
+}
+
+// Checks a free text field for length and control characters
+func validateText(field, value string, maxLength int, multiline bool) error {
+	if utf8.RuneCountInString(value) > maxLength {
+		return fmt.Errorf("%s must be at most %d characters", field, maxLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) && !(multiline && r == '\n') {
+			return fmt.Errorf("%s contains invalid characters", field)
+		}
+	}
+	return nil
+}
+
+// Validates the profile fields and returns the column updates
+func (p profileInput) updates() (map[string]interface{}, error) {
+	updates := map[string]interface{}{}
+
+	if p.DisplayName != nil {
+		value := strings.TrimSpace(*p.DisplayName)
+		if err := validateText("Display name", value, 64, false); err != nil {
+			return nil, err
+		}
+		updates["DisplayName"] = value
+	}
+	if p.Bio != nil {
+		value := strings.TrimSpace(*p.Bio)
+		if err := validateText("Bio", value, 500, true); err != nil {
+			return nil, err
+		}
+		updates["Bio"] = value
+	}
+	if p.Pronouns != nil {
+		value := strings.TrimSpace(*p.Pronouns)
+		if err := validateText("Pronouns", value, 32, false); err != nil {
+			return nil, err
+		}
+		updates["Pronouns"] = value
+	}
+	if p.Timezone != nil {
+		value := strings.TrimSpace(*p.Timezone)
+		if value != "" {
+			if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+				return nil, fmt.Errorf("unknown timezone %q", value)
+			}
+		}
+		updates["Timezone"] = value
+	}
+	if p.Locale != nil {
+		value := strings.TrimSpace(*p.Locale)
+		if value != "" && !localePattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid locale %q", value)
+		}
+		updates["Locale"] = value
+	}
+
+	return updates, nil
+}
+
+// SetupPreferences gives preference columns added after a user saved their
+// preferences the default value instead of NULL
+func SetupPreferences() {
+	if err := inits.DB.Model(&models.UserPreferences{}).Where("discoverable IS NULL").Update("discoverable", true).Error; err != nil {
+		log.Printf("Failed to backfill preferences: %v", err)
+	}
+}
+
+// GetPreferences returns the authenticated user's preferences
+func GetPreferences(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preferences": models.PreferencesFor(inits.DB, userID)})
+}
+
+// UpdatePreferences changes the preferences present in the body and keeps the rest
+func UpdatePreferences(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var input struct {
+		JoinWithCameraOff     *bool `json:"JoinWithCameraOff"`
+		JoinMuted             *bool `json:"JoinMuted"`
+		ShowPresenceToFriends *bool `json:"ShowPresenceToFriends"`
+		Discoverable          *bool `json:"Discoverable"`
+	}
+	// Unknown keys are typos or settings that do not exist, reject them instead of ignoring them
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid preferences: %v", err)})
+		return
+	}
+
+	preferences := models.PreferencesFor(inits.DB, userID)
+	if input.JoinWithCameraOff != nil {
+		preferences.JoinWithCameraOff = *input.JoinWithCameraOff
+	}
+	if input.JoinMuted != nil {
+		preferences.JoinMuted = *input.JoinMuted
+	}
+	if input.ShowPresenceToFriends != nil {
+		preferences.ShowPresenceToFriends = *input.ShowPresenceToFriends
+	}
+	if input.Discoverable != nil {
+		preferences.Discoverable = *input.Discoverable
+	}
+
+	// Save inserts the row the first time and updates it afterwards
+	if err := inits.DB.Save(&preferences).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to save preferences"})
+		return
+	}
+
+	// Hiding or showing presence changes what friends see right away
+	if input.ShowPresenceToFriends != nil {
+		userhub.Refresh(userID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preferences": preferences})
+}
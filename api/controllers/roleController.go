@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// SeedRoles creates the built-in roles and permissions and migrates the old Manager flag
+func SeedRoles() {
+	for roleName, permNames := range models.DefaultRolePermissions {
+		var role models.Role
+		if err := inits.DB.Where(models.Role{Name: roleName}).FirstOrCreate(&role).Error; err != nil {
+			log.Printf("Failed to seed role %s: %v", roleName, err)
+			continue
+		}
+
+		permissions := make([]models.Permission, 0, len(permNames))
+		for _, permName := range permNames {
+			var permission models.Permission
+			if err := inits.DB.Where(models.Permission{Name: permName}).FirstOrCreate(&permission).Error; err != nil {
+				log.Printf("Failed to seed permission %s: %v", permName, err)
+				continue
+			}
+			permissions = append(permissions, permission)
+		}
+
+		// Built-in roles always match the code, custom changes are overwritten on start
+		if err := inits.DB.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+			log.Printf("Failed to set permissions of role %s: %v", roleName, err)
+		}
+	}
+
+	// Managers from before roles existed become admins
+	var managers []models.User
+	inits.DB.Where("manager = ?", true).Find(&managers)
+	for _, manager := range managers {
+		if err := assignRole(&manager, models.RoleAdmin); err != nil {
+			log.Printf("Failed to migrate manager %s: %v", manager.Name, err)
+		}
+	}
+
+	// Users from before roles existed get the default roles
+	var users []models.User
+	inits.DB.Where("id NOT IN (SELECT user_id FROM user_roles)").Find(&users)
+	for i := range users {
+		if err := assignDefaultRoles(&users[i]); err != nil {
+			log.Printf("Failed to assign default roles to %s: %v", users[i].Name, err)
+		}
+	}
+}
+
+// Gives a new user the roles listed in rbac.defaultRoles
+func assignDefaultRoles(user *models.User) error {
+	for _, roleName := range viper.GetStringSlice("rbac.defaultRoles") {
+		if err := assignRole(user, roleName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a role to a user, keeping the Manager flag in sync with the admin role
+func assignRole(user *models.User, roleName string) error {
+	var role models.Role
+	if err := inits.DB.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return fmt.Errorf("role %s not found", roleName)
+	}
+
+	return inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Association("Roles").Append(&role); err != nil {
+			return err
+		}
+		if roleName == models.RoleAdmin && !user.Manager {
+			return tx.Model(user).Update("Manager", true).Error
+		}
+		return nil
+	})
+}
+
+// Removes a role from a user, keeping the Manager flag in sync with the admin role
+func revokeRole(user *models.User, roleName string) error {
+	var role models.Role
+	if err := inits.DB.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return fmt.Errorf("role %s not found", roleName)
+	}
+
+	return inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Association("Roles").Delete(&role); err != nil {
+			return err
+		}
+		if roleName == models.RoleAdmin && user.Manager {
+			return tx.Model(user).Update("Manager", false).Error
+		}
+		return nil
+	})
+}
+
+// Counts the active users holding a role
+func countUsersWithRole(roleName string) int64 {
+	var count int64
+	inits.DB.Table("user_roles").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Joins("JOIN users ON users.id = user_roles.user_id AND users.deleted_at IS NULL").
+		Where("roles.name = ?", roleName).
+		Count(&count)
+	return count
+}
+
+// UserHasPermission checks if any of the user's roles grants the permission
+func UserHasPermission(userID uint, permission string) bool {
+	// Users who still have to enroll in a required 2FA hold no permissions
+	if NeedsTwoFactorSetup(userID) {
+		return false
+	}
+
+	var count int64
+	err := inits.DB.Table("user_roles").
+		Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("user_roles.user_id = ? AND permissions.name = ?", userID, permission).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("Failed to check permission %s for user %d: %v", permission, userID, err)
+		return false
+	}
+	return count > 0
+}
+
+// GetUserPermissions lists the names of every permission the user holds
+func GetUserPermissions(userID uint) []string {
+	var permissions []string
+	inits.DB.Table("permissions").
+		Distinct("permissions.name").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.user_id = ?", userID).
+		Pluck("permissions.name", &permissions)
+	return permissions
+}
+
+// ListRoles returns every role with its permissions
+func ListRoles(c *gin.Context) {
+	var roles []models.Role
+	if err := inits.DB.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+type roleInput struct {
+	Name string `json:"name" binding:"required"` // Target user name
+	Role string `json:"role" binding:"required"`
+}
+
+// UserAssignRole gives a user a role
+func UserAssignRole(c *gin.Context) {
+	var input roleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Where("name = ?", input.Name).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if err := assignRole(&user, input.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	Audit(c, "role.assign", "user", user.ID, user.Name, nil, gin.H{"role": input.Role})
+
+	inits.DB.Preload("Roles").First(&user, user.ID)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// UserRevokeRole takes a role away from a user
+func UserRevokeRole(c *gin.Context) {
+	var input roleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Preload("Roles").Where("name = ?", input.Name).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	// Never lock everyone out of the admin endpoints
+	if input.Role == models.RoleAdmin && user.Manager && countUsersWithRole(models.RoleAdmin) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot revoke the last admin"})
+		return
+	}
+
+	if err := revokeRole(&user, input.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	Audit(c, "role.revoke", "user", user.ID, user.Name, gin.H{"role": input.Role}, nil)
+
+	inits.DB.Preload("Roles").First(&user, user.ID)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
@@ -7,11 +7,18 @@ import (
 	"time"
 	"yuval/inits"
 	"yuval/models"
+	"yuval/utils"
 	"yuval/websocket2"
 
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
 )
 
+// Failed passcodes are throttled per user and session with the login lockout
+func passcodeThrottleKey(userID, sessionID uint) string {
+	return fmt.Sprintf("passcode:%d:%d", userID, sessionID)
+}
+
 // Function to generate a multicast address based on user ID
 func GenerateMulticastIP(userID uint) string {
 	baseIP := [4]int{235, 0, 0, 0}
@@ -30,6 +37,22 @@ func IsUserInSession(sessionID uint, userID uint) (bool, error) {
 	return true, nil
 }
 
+// CanSeeSession checks the user may see a session and its media. While it is active only its
+// current participants may, once it is over everyone who attended and was not banned.
+func CanSeeSession(sessionID uint, userID uint) bool {
+	var session models.Session
+	if err := inits.DB.Select("id", "status").First(&session, sessionID).Error; err != nil {
+		return false
+	}
+	if session.Status == "active" {
+		var count int64
+		inits.DB.Model(&models.UserSession{}).Where("session_id = ? AND user_id = ? AND left_at IS NULL", sessionID, userID).Count(&count)
+		return count > 0
+	}
+	inSession, _ := IsUserInSession(sessionID, userID)
+	return inSession && !IsBannedFromSession(sessionID, userID)
+}
+
 // GetSessionByUserID checks which session the user is in and returns the session ID and mcAddr
 func GetSessionByUserID(userID uint) (uint, string, error) {
 	var userSession models.UserSession
@@ -99,8 +122,7 @@ func GetSessionDetails(c *gin.Context) {
 		return
 	}
 
-	var userSession models.UserSession
-	if err := inits.DB.Where("user_id = ? AND session_id = ?", userID, session.ID).First(&userSession).Error; err != nil {
+	if !CanSeeSession(session.ID, userID) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "You are not in this session"})
 		return
 	}
@@ -114,6 +136,19 @@ func GetSessionDetails(c *gin.Context) {
 
 	// Prepare a list to hold the response data
 	var response []map[string]interface{}
+	moderators := map[uint]bool{}
+	for _, id := range sessionModerators(session) {
+		moderators[id] = true
+	}
+	role := func(id uint) string {
+		if id == session.HostID {
+			return "host"
+		}
+		if moderators[id] {
+			return "cohost"
+		}
+		return "participant"
+	}
 
 	// Add the current user as the first item
 	var currentUser models.User
@@ -124,6 +159,7 @@ func GetSessionDetails(c *gin.Context) {
 			"streamURL": currentUserStreamURL,
 			"name":      currentUser.Name,
 			"id":        currentUser.ID,
+			"role":      role(currentUser.ID),
 		})
 	}
 
@@ -147,6 +183,7 @@ func GetSessionDetails(c *gin.Context) {
 			"streamURL": streamURL,
 			"name":      user.Name,
 			"id":        user.ID,
+			"role":      role(user.ID),
 		})
 	}
 
@@ -154,6 +191,11 @@ func GetSessionDetails(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"session_id":   session.ID,
 		"participants": response, // This is the new list with the current user first
+		"moderator":    moderators[userID],
+		"waitingRoom":  session.WaitingRoom,
+		"private":      session.Private,
+		"hasPasscode":  len(session.PasscodeHash) > 0,
+		"locked":       session.Locked,
 	})
 }
 
@@ -172,7 +214,16 @@ func DeleteUserSessionCurrent(userID uint, sessionID uint) error {
 }
 
 // CreateUserSession ensures that a user is not in another session before joining.
+// Joining a session everyone had left makes it active again.
 func CreateUserSession(userID uint, sessionID uint) error {
+	var session models.Session
+	if err := inits.DB.Select("id", "status").First(&session, sessionID).Error; err != nil {
+		return fmt.Errorf("session not found")
+	}
+	if session.Status == "ended" {
+		return fmt.Errorf("the meeting has ended")
+	}
+
 	err := DeleteUserSessionCurrent(userID, sessionID)
 	if err != nil {
 		return err
@@ -188,13 +239,23 @@ func CreateUserSession(userID uint, sessionID uint) error {
 		return fmt.Errorf("failed to create user session: %v", err)
 	}
 
+	// The next time it empties, HandleSessionEnd runs again for what was recorded since
+	if err := inits.DB.Model(&models.Session{}).Where("id = ? AND status = ?", sessionID, "inactive").Update("status", "active").Error; err != nil {
+		return fmt.Errorf("failed to reactivate session: %v", err)
+	}
+
 	return nil
 }
 
 // CreateSession handles the creation of a new session.
 func CreateSession(c *gin.Context) {
 	var input struct {
-		Name string `json:"name" binding:"required"`
+		Name        string   `json:"name" binding:"required"`
+		GroupID     *uint    `json:"groupId"`                   // Contact group to invite
+		Invite      []string `json:"invite"`                    // Names of further users to invite
+		Private     bool     `json:"private"`                   // Only invited users may join
+		Passcode    string   `json:"passcode" binding:"max=64"` // Optional, asked from everyone but moderators and invitees
+		WaitingRoom bool     `json:"waitingRoom"`               // Joining users wait to be admitted
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -208,11 +269,35 @@ func CreateSession(c *gin.Context) {
 		return
 	}
 
+	// Resolve the invitees before anything is created, a bad group or name creates no session
+	var inviteIDs []uint
+	if input.GroupID != nil {
+		inviteIDs, err = GroupMemberIDs(userID, *input.GroupID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+			return
+		}
+	}
+	named, err := inviteesByName(userID, input.Invite)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	inviteIDs = append(inviteIDs, named...)
+
 	// Initially, create a session without the multicast address
 	session := models.Session{
-		Name:   input.Name,
-		HostID: userID,
-		Status: "active",
+		Name:        input.Name,
+		HostID:      userID,
+		Status:      "active",
+		Private:     input.Private,
+		WaitingRoom: input.WaitingRoom,
+	}
+	if input.Passcode != "" {
+		if session.PasscodeHash, err = utils.HashPassword(input.Passcode); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set the passcode"})
+			return
+		}
 	}
 
 	// Create the session in the database to generate an ID (id should auto-increment)
@@ -246,14 +331,17 @@ func CreateSession(c *gin.Context) {
 		return
 	}
 
+	invited := inviteToSession(session, userID, inviteIDs)
+
 	// Respond with the session creation success
-	c.JSON(http.StatusOK, gin.H{"message": "Session created successfully", "session_id": session.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Session created successfully", "session_id": session.ID, "invited": invited})
 }
 
 // JoinSession allows a user to join a session.
 func JoinSession(c *gin.Context) {
 	var input struct {
-		Name string `json:"name" binding:"required"`
+		Name     string `json:"name" binding:"required"`
+		Passcode string `json:"passcode"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -273,6 +361,67 @@ func JoinSession(c *gin.Context) {
 		return
 	}
 
+	// Hosts decide who may join, so a user they blocked is turned away
+	if HasBlocked(session.HostID, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot join this session"})
+		return
+	}
+
+	if session.Status == "ended" {
+		c.JSON(http.StatusGone, gin.H{"error": "The host ended this meeting"})
+		return
+	}
+	if IsBannedFromSession(session.ID, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You were removed from this meeting"})
+		return
+	}
+
+	// Moderators and invited users were chosen by the host, so they skip the passcode and waiting room
+	moderator := IsSessionModerator(session, userID)
+	if session.Locked && !moderator {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The meeting is locked"})
+		return
+	}
+	invitation, err := findInvitation(session.ID, userID)
+	invited := err == nil && (invitation.Status == models.InvitePending || invitation.Status == models.InviteAccepted)
+
+	// Private sessions take moderators and invited users only
+	if session.Private && !moderator && !invited {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This session is private, you need an invitation"})
+		return
+	}
+
+	if len(session.PasscodeHash) > 0 && !moderator && !invited {
+		key := passcodeThrottleKey(userID, session.ID)
+		if remaining := loginLockRemaining(key); remaining > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong passcodes, try again later"})
+			return
+		}
+		if err := utils.CheckPassword(session.PasscodeHash, input.Passcode); err != nil {
+			if input.Passcode != "" {
+				recordLoginFailure(key, viper.GetInt("sessions.passcodeMaxAttempts"))
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": "A valid passcode is required", "passcodeRequired": true})
+			return
+		}
+		clearLoginFailures(key)
+	}
+
+	// Users already admitted once come back without waiting again
+	if session.WaitingRoom && !moderator && !invited && !admittedFromWaitingRoom(session.ID, userID) {
+		if err := enterWaitingRoom(session, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Waiting for the host to admit you", "waiting": true, "session_id": session.ID})
+		return
+	}
+
+	if invited && invitation.Status == models.InvitePending {
+		respondToInvitation(&invitation, models.InviteAccepted)
+	}
+
 	if err := CreateUserSession(userID, session.ID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -284,3 +433,60 @@ func JoinSession(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Successfully joined the session", "session_id": session.ID})
 }
+
+// UpdateSessionSettings changes the passcode, waiting room and privacy of a session the authenticated user hosts
+func UpdateSessionSettings(c *gin.Context) {
+	var input struct {
+		Passcode    *string `json:"passcode" binding:"omitempty,max=64"` // Empty removes the passcode
+		WaitingRoom *bool   `json:"waitingRoom"`
+		Private     *bool   `json:"private"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	session, ok := hostedSession(c, userID)
+	if !ok {
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if input.Passcode != nil {
+		var hash []byte
+		if *input.Passcode != "" {
+			if hash, err = utils.HashPassword(*input.Passcode); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to set the passcode"})
+				return
+			}
+		}
+		updates["passcode_hash"] = hash
+	}
+	if input.WaitingRoom != nil {
+		updates["waiting_room"] = *input.WaitingRoom
+	}
+	if input.Private != nil {
+		updates["private"] = *input.Private
+	}
+	if len(updates) > 0 {
+		if err := inits.DB.Model(&session).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to update the session"})
+			return
+		}
+		inits.DB.First(&session, session.ID)
+	}
+
+	// Turning the waiting room off lets everyone still waiting in
+	if input.WaitingRoom != nil && !*input.WaitingRoom {
+		for _, waiting := range waitingUsers(session.ID) {
+			decideWaiting(session, userID, waiting.User.ID, true)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session updated", "waitingRoom": session.WaitingRoom, "private": session.Private, "hasPasscode": len(session.PasscodeHash) > 0})
+}
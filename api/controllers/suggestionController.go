@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultSuggestionLimit = 10
+	maxSuggestionLimit     = 50
+)
+
+// Ranks everyone the user met in a session or shares a friend with. Time in a meeting
+// counts from joined_at to left_at, or to now for someone still in it.
+const suggestionQuery = `
+WITH co_attendance AS (
+	SELECT b.user_id AS other_id,
+		COUNT(DISTINCT a.session_id) AS shared_meetings,
+		SUM(GREATEST(0,
+			LEAST(COALESCE(NULLIF(a.left_at, 0), @now), COALESCE(NULLIF(b.left_at, 0), @now))
+			- GREATEST(a.joined_at, b.joined_at))) AS overlap_seconds
+	FROM user_sessions a
+	JOIN user_sessions b ON b.session_id = a.session_id AND b.user_id <> a.user_id AND b.deleted_at IS NULL
+	WHERE a.user_id = @me AND a.deleted_at IS NULL
+	GROUP BY b.user_id
+),
+my_friends AS (
+	SELECT CASE WHEN user_id = @me THEN friend_id ELSE user_id END AS id
+	FROM friends
+	WHERE (user_id = @me OR friend_id = @me) AND status = @accepted AND deleted_at IS NULL
+),
+mutual AS (
+	SELECT CASE WHEN f.user_id = mf.id THEN f.friend_id ELSE f.user_id END AS other_id,
+		COUNT(*) AS mutual_friends
+	FROM friends f
+	JOIN my_friends mf ON f.user_id = mf.id OR f.friend_id = mf.id
+	WHERE f.status = @accepted AND f.deleted_at IS NULL
+	GROUP BY 1
+),
+ranked AS (
+	SELECT u.*,
+		COALESCE(co.shared_meetings, 0) AS shared_meetings,
+		COALESCE(co.overlap_seconds, 0) AS overlap_seconds,
+		COALESCE(m.mutual_friends, 0) AS mutual_friends,
+		COALESCE(co.shared_meetings, 0) * CAST(@meetingWeight AS double precision)
+			+ COALESCE(co.overlap_seconds, 0) / 3600.0 * CAST(@overlapWeight AS double precision)
+			+ COALESCE(m.mutual_friends, 0) * CAST(@mutualWeight AS double precision) AS score
+	FROM users u
+	LEFT JOIN co_attendance co ON co.other_id = u.id
+	LEFT JOIN mutual m ON m.other_id = u.id
+	WHERE (co.other_id IS NOT NULL OR m.other_id IS NOT NULL)
+		AND u.id <> @me
+		AND u.deleted_at IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM friends f
+			WHERE ((f.user_id = @me AND f.friend_id = u.id) OR (f.user_id = u.id AND f.friend_id = @me))
+				AND f.status IN @open AND f.deleted_at IS NULL)
+		AND NOT EXISTS (
+			SELECT 1 FROM blocks bl
+			WHERE ((bl.user_id = @me AND bl.blocked_id = u.id) OR (bl.user_id = u.id AND bl.blocked_id = @me))
+				AND bl.deleted_at IS NULL)
+		AND NOT EXISTS (
+			SELECT 1 FROM suggestion_dismissals d
+			WHERE d.user_id = @me AND d.dismissed_id = u.id AND d.deleted_at IS NULL)
+		AND NOT EXISTS (
+			SELECT 1 FROM user_preferences p
+			WHERE p.user_id = u.id AND p.discoverable = false AND p.deleted_at IS NULL)
+)
+SELECT * FROM ranked ORDER BY score DESC, id LIMIT @limit`
+
+// FriendSuggestions returns people the user may know, best match first
+//
+// Users rank higher the more meetings they shared with the user, the longer they were
+// in them at the same time and the more friends they have in common. Friends, open
+// requests, blocks, dismissed suggestions and users who are not discoverable are left out.
+func FriendSuggestions(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	limit := defaultSuggestionLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit"})
+			return
+		}
+		if n > maxSuggestionLimit {
+			n = maxSuggestionLimit
+		}
+		limit = n
+	}
+
+	var rows []struct {
+		models.User
+		SharedMeetings int64
+		OverlapSeconds int64
+		MutualFriends  int64
+		Score          float64
+	}
+	err = inits.DB.Raw(suggestionQuery, map[string]interface{}{
+		"me":            userID,
+		"now":           time.Now().Unix(),
+		"accepted":      models.FriendAccepted,
+		"open":          []string{models.FriendPending, models.FriendAccepted},
+		"meetingWeight": viper.GetFloat64("suggestions.meetingWeight"),
+		"overlapWeight": viper.GetFloat64("suggestions.overlapHourWeight"),
+		"mutualWeight":  viper.GetFloat64("suggestions.mutualFriendWeight"),
+		"limit":         limit,
+	}).Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching suggestions"})
+		return
+	}
+
+	suggestions := make([]gin.H, 0, len(rows))
+	for _, row := range rows {
+		suggestions = append(suggestions, gin.H{
+			"user":           row.User.Public(),
+			"sharedMeetings": row.SharedMeetings,
+			"overlapMinutes": row.OverlapSeconds / 60,
+			"mutualFriends":  row.MutualFriends,
+			"score":          row.Score,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"suggestions": suggestions})
+}
+
+// DismissSuggestion stops a user from being suggested to the authenticated user again
+func DismissSuggestion(c *gin.Context) {
+	var input struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var other models.User
+	if err := inits.DB.Where("name = ?", input.Name).First(&other).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	dismissal := models.SuggestionDismissal{UserID: userID, DismissedID: other.ID}
+	if err := inits.DB.Where(dismissal).FirstOrCreate(&dismissal).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to dismiss suggestion"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Suggestion dismissed"})
+}
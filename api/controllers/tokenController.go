@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Generates a URL-safe random string of n bytes of entropy
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hashes a token before it is stored so a database leak does not leak live tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func accessTokenTTL() time.Duration {
+	return time.Duration(viper.GetInt("auth.accessTokenMinutes")) * time.Minute
+}
+
+func refreshTokenTTL() time.Duration {
+	return time.Duration(viper.GetInt("auth.refreshTokenHours")) * time.Hour
+}
+
+// Sets the access and refresh cookies on the response
+func setAuthCookies(c *gin.Context, accessToken, refreshToken string) {
+	c.SetCookie("JWT", accessToken, int(accessTokenTTL().Seconds()), "/", "localhost", false, true)
+	c.SetCookie("Refresh", refreshToken, int(refreshTokenTTL().Seconds()), "/users", "localhost", false, true)
+}
+
+// Clears the access and refresh cookies
+func clearAuthCookies(c *gin.Context) {
+	c.SetCookie("JWT", "", -1, "/", "localhost", false, true)
+	c.SetCookie("Refresh", "", -1, "/users", "localhost", false, true)
+}
+
+// IssueTokens creates a new persisted token pair for the user and sets the cookies
+func IssueTokens(c *gin.Context, user models.User) error {
+	accessToken, refreshToken, err := createTokenPair(inits.DB, c, user)
+	if err != nil {
+		return err
+	}
+
+	setAuthCookies(c, accessToken, refreshToken)
+	return nil
+}
+
+// Stores a new token pair with tx and returns the signed access token and the refresh token
+func createTokenPair(tx *gorm.DB, c *gin.Context, user models.User) (string, string, error) {
+	secret := viper.GetString("secret")
+	if secret == "" {
+		return "", "", fmt.Errorf("secret key is missing")
+	}
+
+	accessID, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	authToken := models.AuthToken{
+		UserID:           user.ID,
+		AccessID:         accessID,
+		RefreshHash:      hashToken(refreshToken),
+		AccessExpiresAt:  now.Add(accessTokenTTL()),
+		RefreshExpiresAt: now.Add(refreshTokenTTL()),
+		UserAgent:        c.Request.UserAgent(),
+		IP:               c.ClientIP(),
+	}
+	if err := tx.Create(&authToken).Error; err != nil {
+		return "", "", fmt.Errorf("failed to store token: %v", err)
+	}
+
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Issuer:    strconv.Itoa(int(user.ID)),
+		Id:        accessID,
+		ExpiresAt: authToken.AccessExpiresAt.Unix(),
+	})
+
+	accessToken, err := claims.SignedString([]byte(secret))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign token: %v", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// Parses and validates an access JWT, returning the user ID and token ID
+func parseAccessToken(tokenString string) (string, string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(viper.GetString("secret")), nil
+	})
+	if err != nil || !token.Valid {
+		return "", "", fmt.Errorf("invalid token")
+	}
+
+	// Tokens made for another purpose, like a 2FA challenge, are not access tokens
+	claims := token.Claims.(jwt.MapClaims)
+	if _, hasAudience := claims["aud"]; hasAudience {
+		return "", "", fmt.Errorf("not an access token")
+	}
+
+	userID, ok := claims["iss"].(string)
+	if !ok {
+		return "", "", fmt.Errorf("invalid token issuer")
+	}
+	accessID, ok := claims["jti"].(string)
+	if !ok || accessID == "" {
+		return "", "", fmt.Errorf("token has no ID")
+	}
+
+	return userID, accessID, nil
+}
+
+// Checks the revocation table for the access token ID
+func isAccessTokenRevoked(accessID string) bool {
+	var count int64
+	if err := inits.DB.Model(&models.RevokedToken{}).Where("access_id = ?", accessID).Count(&count).Error; err != nil {
+		log.Printf("Failed to check token revocation: %v", err)
+		return true
+	}
+	return count > 0
+}
+
+// RevokeAuthToken revokes a single token pair and blacklists its access token
+func RevokeAuthToken(authToken *models.AuthToken, reason string) error {
+	return revokeAuthToken(inits.DB, authToken, reason)
+}
+
+func revokeAuthToken(tx *gorm.DB, authToken *models.AuthToken, reason string) error {
+	if authToken.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	authToken.RevokedAt = &now
+	if err := tx.Save(authToken).Error; err != nil {
+		return err
+	}
+
+	// Access tokens that already expired can no longer be used, no need to list them
+	if authToken.AccessExpiresAt.Before(now) {
+		return nil
+	}
+
+	return tx.Create(&models.RevokedToken{
+		AccessID:  authToken.AccessID,
+		UserID:    authToken.UserID,
+		ExpiresAt: authToken.AccessExpiresAt,
+		Reason:    reason,
+	}).Error
+}
+
+// RevokeAllUserTokens revokes every active token pair of a user
+func RevokeAllUserTokens(userID uint, reason string) error {
+	var tokens []models.AuthToken
+	if err := inits.DB.Where("user_id = ? AND revoked_at IS NULL", userID).Find(&tokens).Error; err != nil {
+		return err
+	}
+
+	for i := range tokens {
+		if err := RevokeAuthToken(&tokens[i], reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returned from the refresh transaction when another request rotated the token first
+var errRefreshTokenUsed = errors.New("refresh token already used")
+
+// RefreshTokens exchanges a valid refresh cookie for a new token pair
+func RefreshTokens(c *gin.Context) {
+	refreshToken, err := c.Cookie("Refresh")
+	if err != nil || refreshToken == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+		return
+	}
+
+	var authToken models.AuthToken
+	if err := inits.DB.Where("refresh_hash = ?", hashToken(refreshToken)).First(&authToken).Error; err != nil {
+		clearAuthCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+		return
+	}
+
+	// A revoked refresh token being replayed means it leaked, so sign the user out everywhere
+	if authToken.RevokedAt != nil {
+		log.Printf("Refresh token reuse detected for user %d", authToken.UserID)
+		if err := RevokeAllUserTokens(authToken.UserID, "refresh token reuse"); err != nil {
+			log.Printf("Failed to revoke tokens: %v", err)
+		}
+		clearAuthCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+		return
+	}
+
+	if authToken.RefreshExpiresAt.Before(time.Now()) {
+		clearAuthCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Session expired"})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, authToken.UserID).Error; err != nil {
+		clearAuthCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+		return
+	}
+
+	// Rotate: the old pair is revoked and the new one stored together, so a failure
+	// leaves neither a usable old pair nor a user without tokens
+	var accessToken, newRefreshToken string
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		// Locked so two concurrent refreshes with the same token cannot both rotate it
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&authToken, authToken.ID).Error; err != nil {
+			return err
+		}
+		if authToken.RevokedAt != nil {
+			return errRefreshTokenUsed
+		}
+		if err := revokeAuthToken(tx, &authToken, "rotated"); err != nil {
+			return err
+		}
+		accessToken, newRefreshToken, err = createTokenPair(tx, c, user)
+		return err
+	})
+	if errors.Is(err, errRefreshTokenUsed) {
+		clearAuthCookies(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error refreshing token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to refresh token"})
+		return
+	}
+	setAuthCookies(c, accessToken, newRefreshToken)
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// LogOutEverywhere revokes every token pair of the authenticated user
+func LogOutEverywhere(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := RevokeAllUserTokens(userID, "logout everywhere"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to log out"})
+		return
+	}
+
+	clearAuthCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out from all devices"})
+}
+
+// StartTokenPruner periodically removes expired token rows
+func StartTokenPruner() {
+	for {
+		now := time.Now()
+		if err := inits.DB.Unscoped().Where("expires_at < ?", now).Delete(&models.RevokedToken{}).Error; err != nil {
+			log.Printf("Failed to prune revoked tokens: %v", err)
+		}
+		if err := inits.DB.Unscoped().Where("refresh_expires_at < ?", now).Delete(&models.AuthToken{}).Error; err != nil {
+			log.Printf("Failed to prune auth tokens: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// UserRevokeTokens lets an admin force a user out of every device
+func UserRevokeTokens(c *gin.Context) {
+	var input struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Where("name = ?", input.Name).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if err := RevokeAllUserTokens(user.ID, "revoked by admin"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to revoke user tokens"})
+		return
+	}
+	Audit(c, "user.revoke_tokens", "user", user.ID, user.Name, nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "User tokens revoked"})
+}
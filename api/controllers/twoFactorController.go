@@ -0,0 +1,409 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/utils"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+const (
+	twoFactorAudience     = "2fa"
+	twoFactorChallengeTTL = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+// Signs a short-lived token proving the password step of the login succeeded
+func createTwoFactorChallenge(user models.User) (string, error) {
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Issuer:    strconv.Itoa(int(user.ID)),
+		Audience:  twoFactorAudience,
+		ExpiresAt: time.Now().Add(twoFactorChallengeTTL).Unix(),
+	})
+	return claims.SignedString([]byte(viper.GetString("secret")))
+}
+
+// Returns the user ID of a valid challenge token
+func parseTwoFactorChallenge(challenge string) (string, error) {
+	token, err := jwt.Parse(challenge, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(viper.GetString("secret")), nil
+	})
+	if err != nil || !token.Valid {
+		return "", errors.New("invalid or expired challenge")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyAudience(twoFactorAudience, true) {
+		return "", errors.New("invalid challenge")
+	}
+	userID, ok := claims["iss"].(string)
+	if !ok {
+		return "", errors.New("invalid challenge")
+	}
+	return userID, nil
+}
+
+// Generates new recovery codes, replacing the old ones, and returns them in plain text
+func generateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		raw, err := randomToken(8)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(raw[:5] + "-" + raw[5:10])
+		if err := tx.Create(&models.RecoveryCode{UserID: userID, CodeHash: hashToken(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Checks a TOTP code or, failing that, uses up a recovery code
+func verifySecondFactor(user *models.User, code, recoveryCode string) bool {
+	if code != "" {
+		counter, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+		if !ok {
+			return false
+		}
+		// Only one login per code, even within its 30 second window
+		result := inits.DB.Model(user).
+			Where("totp_last_counter < ?", counter).
+			Update("totp_last_counter", counter)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	if recoveryCode != "" {
+		result := inits.DB.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(strings.ToLower(strings.TrimSpace(recoveryCode)))).
+			Update("used_at", time.Now())
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	return false
+}
+
+// Whether 2FA is required of the user, by their own flag or by one of their roles
+func twoFactorRequired(user models.User) bool {
+	if user.TwoFactorRequired {
+		return true
+	}
+	var count int64
+	inits.DB.Table("user_roles").
+		Joins("JOIN roles ON roles.id = user_roles.role_id AND roles.deleted_at IS NULL").
+		Where("user_roles.user_id = ? AND roles.require_two_factor = ?", user.ID, true).
+		Count(&count)
+	return count > 0
+}
+
+// NeedsTwoFactorSetup reports whether the user must enroll in 2FA before using privileged routes
+func NeedsTwoFactorSetup(userID uint) bool {
+	var user models.User
+	if err := inits.DB.Select("id", "two_factor_required", "totp_enabled").First(&user, userID).Error; err != nil {
+		return false
+	}
+	return !user.TOTPEnabled && twoFactorRequired(user)
+}
+
+// LoginTwoFactor finishes a login with a TOTP or recovery code and issues the JWT
+func LoginTwoFactor(c *gin.Context) {
+	var input struct {
+		Challenge    string `json:"challenge" binding:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request"})
+		return
+	}
+
+	userID, err := parseTwoFactorChallenge(input.Challenge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil || !user.TOTPEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid challenge"})
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	accountKey := accountThrottleKey(user.Name)
+	if remaining := loginLockRemaining(accountKey); remaining > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many failed login attempts, try again later"})
+		return
+	}
+
+	if !verifySecondFactor(&user, input.Code, input.RecoveryCode) {
+		if err := recordLoginFailure(accountKey, viper.GetInt("login.maxAttempts")); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	if err := clearLoginFailures(accountKey); err != nil {
+		log.Printf("Failed to clear login failures: %v", err)
+	}
+
+	if err := IssueTokens(c, user); err != nil {
+		log.Printf("Error creating token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "mustChangePassword": user.MustChangePassword})
+}
+
+// EnrollTwoFactor creates a new TOTP secret for the authenticated user
+func EnrollTwoFactor(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate secret"})
+		return
+	}
+
+	// The secret stays inactive until the user proves their app can produce codes
+	if err := inits.DB.Model(&user).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_counter": 0}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to save secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    utils.TOTPProvisioningURI(viper.GetString("twoFactor.issuer"), user.Name, secret),
+	})
+}
+
+// ConfirmTwoFactor enables 2FA once the user enters a valid code, and returns the recovery codes
+func ConfirmTwoFactor(c *gin.Context) {
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Start the enrollment first"})
+		return
+	}
+
+	counter, ok := utils.ValidateTOTP(user.TOTPSecret, input.Code, time.Now(), user.TOTPLastCounter)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{"totp_enabled": true, "totp_last_counter": counter}).Error; err != nil {
+			return err
+		}
+		codes, err = generateRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	// The codes are only shown once, we keep just their hashes
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recoveryCodes": codes})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a current TOTP code
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil || !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if !verifySecondFactor(&user, input.Code, "") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		codes, err = generateRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// DisableTwoFactor turns 2FA off after checking a code and the password, or a recent
+// re-authentication with the identity provider
+func DisableTwoFactor(c *gin.Context) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil || !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if twoFactorRequired(user) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Two-factor authentication is required for your account"})
+		return
+	}
+
+	// Wrong passwords and codes count towards the login lockout, also after a re-authentication
+	accountKey := accountThrottleKey(user.Name)
+	if remaining := loginLockRemaining(accountKey); remaining > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many failed attempts, try again later"})
+		return
+	}
+	if !recentlyReauthenticated(c, user.ID) && !checkPasswordThrottled(c, user, input.Password, "Incorrect password") {
+		return
+	}
+	if !verifySecondFactor(&user, input.Code, input.RecoveryCode) {
+		if err := recordLoginFailure(accountKey, viper.GetInt("login.maxAttempts")); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	err = inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_counter": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RequireTwoFactorForManagers turns the 2FA requirement of the admin role on or off,
+// it applies to everyone who holds the role now or gets it later
+func RequireTwoFactorForManagers(c *gin.Context) {
+	var input struct {
+		Required *bool `json:"required" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	var role models.Role
+	if err := inits.DB.Where("name = ?", models.RoleAdmin).First(&role).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Role not found"})
+		return
+	}
+	before := role.RequireTwoFactor
+
+	err := inits.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&role).Update("require_two_factor", *input.Required).Error; err != nil {
+			return err
+		}
+		// Earlier versions of this policy flagged each manager, turning it off clears those flags too
+		if !*input.Required {
+			return tx.Model(&models.User{}).Where("manager = ?", true).Update("two_factor_required", false).Error
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to update the role"})
+		return
+	}
+	users := countUsersWithRole(models.RoleAdmin)
+	Audit(c, "security.require_2fa", "role", role.ID, role.Name, gin.H{"required": before}, gin.H{"required": *input.Required, "users": users})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor requirement updated", "users": users})
+}
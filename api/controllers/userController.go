@@ -5,14 +5,14 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 	"yuval/inits"
 	"yuval/models"
+	"yuval/utils"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Get user details
@@ -25,41 +25,41 @@ func User(c *gin.Context) {
 
 	userIDStr := fmt.Sprintf("%v", userID)
 	var user models.User
-	if err := inits.DB.Where("id = ?", userIDStr).First(&user).Error; err != nil {
+	if err := inits.DB.Preload("Roles").Where("id = ?", userIDStr).First(&user).Error; err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"user": user})
+	c.JSON(http.StatusOK, gin.H{"user": user, "permissions": GetUserPermissions(user.ID)})
 }
 
-// Extracts user ID from JWT cookie and checks if the user is authenticated
+// Extracts user ID from the Authorization header or JWT cookie and checks if the user is authenticated
 func GetUserIDFromToken(c *gin.Context) (string, error) {
-	// Step 1: Retrieve the JWT cookie
-	cookieValue, err := c.Cookie("JWT")
-	if err != nil {
-		return "", err
+	// Step 1: Prefer an "Authorization: Bearer" header, fall back to the JWT cookie
+	tokenString := bearerToken(c)
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		return authenticateAPIKey(c, tokenString)
+	}
+	if tokenString == "" {
+		cookieValue, err := c.Cookie("JWT")
+		if err != nil {
+			return "", err
+		}
+		tokenString = cookieValue
 	}
 
-	// Step 2: Parse the token
-	token, err := jwt.Parse(cookieValue, func(token *jwt.Token) (interface{}, error) {
-		return []byte(viper.GetString("secret")), nil
-	})
-	if err != nil || !token.Valid {
+	// Step 2: Parse the token and extract the user ID and token ID
+	userID, accessID, err := parseAccessToken(tokenString)
+	if err != nil {
 		return "", err
 	}
 
-	// Step 3: Extract user ID from claims
-	claims := token.Claims.(jwt.MapClaims)
-	userID, ok := claims["iss"].(string)
-	if !ok {
-		return "", err
+	// Step 3: Reject tokens that were revoked before they expired
+	if isAccessTokenRevoked(accessID) {
+		return "", fmt.Errorf("token revoked")
 	}
 
-	// Step 4: Extend the cookie's expiration time
-	maxAge := 30 * 60 // 30 minutes
-	c.SetCookie("JWT", cookieValue, maxAge, "/", "", false, true)
-
+	c.Set("tokenID", accessID)
 	return userID, nil
 }
 
@@ -73,124 +73,251 @@ func IsUserAuthenticatedGetId(c *gin.Context) (bool, string) {
 	return true, userID
 }
 
-// Checks if the user is a manager
-func IsUserManager(c *gin.Context) bool {
-	isAuthenticated, userID := IsUserAuthenticatedGetId(c)
-	if !isAuthenticated {
-		return false
-	}
-
-	var currentUser models.User
-	if err := inits.DB.Where("id = ?", userID).First(&currentUser).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized: User not found"})
-		return false
-	}
-
-	return currentUser.Manager
-}
-
-var account struct {
-	Name     string
-	Password string
-	ImgPath  string
-	Manager  bool
-}
-
 // Create a new user
 func UsersCreate(c *gin.Context) {
+	var input struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
 
 	// Bind JSON input
-	if err := c.ShouldBindJSON(&account); err != nil {
+	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
 		return
 	}
 
 	// Check if the user already exists
 	var existingUser models.User
-	result := inits.DB.Where("name = ?", account.Name).First(&existingUser)
+	result := inits.DB.Where("name = ?", input.Name).First(&existingUser)
 	if result.Error == nil {
 		// User already exists
 		c.JSON(http.StatusBadRequest, gin.H{"message": "User already signed up, try signing in"})
 		return
 	}
 
+	// Deactivated accounts keep their name until they are purged
+	if inits.DB.Unscoped().Where("name = ?", input.Name).First(&existingUser).Error == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This name is already taken"})
+		return
+	}
+
+	// The email address is optional, but must be valid and unused when given
+	email := ""
+	if input.Email != "" {
+		normalized, err := normalizeEmail(input.Email)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid email address"})
+			return
+		}
+		if isEmailTaken(normalized, 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Email address already in use"})
+			return
+		}
+		email = normalized
+	}
+
+	if err := utils.ValidatePassword(input.Password, input.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
 	// Hash the password
-	password, err := bcrypt.GenerateFromPassword([]byte(account.Password), 14)
+	password, err := utils.HashPassword(input.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error hashing password"})
 		return
 	}
 
-	// Create the new user
+	// Create the new user, the avatar can only be set later through UploadAvatar
 	user := models.User{
-		Name:     account.Name,
+		Name:     input.Name,
 		Password: password,
-		ImgPath:  account.ImgPath,
+		Email:    email,
 		Manager:  false,
 	}
 
 	result = inits.DB.Create(&user)
 	if result.Error != nil {
-		c.Status(http.StatusBadRequest)
+		log.Printf("Failed to create user %s: %v", input.Name, result.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to create user"})
 		return
 	}
 
+	if err := assignDefaultRoles(&user); err != nil {
+		log.Printf("Failed to assign default roles: %v", err)
+	}
+
+	if user.Email != "" {
+		if err := sendVerificationEmail(user); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
+// Same answer for unknown names and wrong passwords so names cannot be enumerated
+const invalidCredentialsMessage = "Invalid username or password"
+
 // User login function
 func Login(c *gin.Context) {
 
-	if err := c.ShouldBindJSON(&account); err != nil {
+	var input struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
 		log.Printf("Database error: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request"})
 		return
 	}
 
+	// Refuse early while the account name or the caller's IP is locked out
+	accountKey := accountThrottleKey(input.Name)
+	ipKey := ipThrottleKey(c.ClientIP())
+	if remaining := max(loginLockRemaining(accountKey), loginLockRemaining(ipKey)); remaining > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many failed login attempts, try again later"})
+		return
+	}
+
 	var user models.User
-	result := inits.DB.Where("name = ?", account.Name).First(&user)
+	result := inits.DB.Where("name = ?", input.Name).First(&user)
 
+	passwordErr := error(nil)
 	if result.Error != nil {
 		log.Printf("Database error: %v", result.Error)
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not found"})
-		return
+		compareDummyPassword(input.Password)
+		passwordErr = result.Error
+	} else {
+		passwordErr = utils.CheckPassword(user.Password, input.Password)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(account.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "Incorrect password"})
+	if passwordErr != nil {
+		if err := recordLoginFailure(accountKey, viper.GetInt("login.maxAttempts")); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		if err := recordLoginFailure(ipKey, viper.GetInt("login.ipMaxAttempts")); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"message": invalidCredentialsMessage})
 		return
 	}
 
-	secret := viper.GetString("secret")
-	if secret == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Secret key is missing"})
-		return
+	if err := clearLoginFailures(accountKey); err != nil {
+		log.Printf("Failed to clear login failures: %v", err)
 	}
 
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Issuer:    strconv.Itoa(int(user.ID)),
-		ExpiresAt: time.Now().Add(time.Minute * 30).Unix(),
-	})
+	// Old bcrypt hashes are upgraded now that we know the plain password
+	if utils.PasswordNeedsRehash(user.Password) {
+		if password, err := utils.HashPassword(input.Password); err == nil {
+			if err := inits.DB.Model(&user).Update("password", password).Error; err != nil {
+				log.Printf("Failed to rehash password: %v", err)
+			}
+		}
+	}
 
-	token, err := claims.SignedString([]byte(secret))
-	if err != nil {
+	// With 2FA enabled the password only earns a challenge for the second step
+	if user.TOTPEnabled {
+		challenge, err := createTwoFactorChallenge(user)
+		if err != nil {
+			log.Printf("Error creating 2FA challenge: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"twoFactorRequired": true, "challenge": challenge})
+		return
+	}
+
+	if err := IssueTokens(c, user); err != nil {
 		log.Printf("Error creating token: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create token"})
 		return
 	}
 
-	// Set cookie to expire in 30 minutes
-	c.SetCookie("JWT", token, 30*60, "/", "localhost", false, true)
-
-	c.JSON(http.StatusOK, gin.H{"user": user})
+	c.JSON(http.StatusOK, gin.H{"user": user, "twoFactorSetupRequired": twoFactorRequired(user), "mustChangePassword": user.MustChangePassword})
 }
 
 // Log out user
 func LogOut(c *gin.Context) {
-	c.SetCookie("JWT", "", -1, "/", "", false, true)
+	if accessID, exists := c.Get("tokenID"); exists {
+		var authToken models.AuthToken
+		if err := inits.DB.Where("access_id = ?", accessID).First(&authToken).Error; err == nil {
+			if err := RevokeAuthToken(&authToken, "logout"); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to log out"})
+				return
+			}
+		}
+	}
+
+	clearAuthCookies(c)
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
 
+// ChangePassword replaces the authenticated user's password after checking the current one
+func ChangePassword(c *gin.Context) {
+	var input struct {
+		CurrentPassword string `json:"currentPassword" binding:"required"`
+		NewPassword     string `json:"newPassword" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if !checkPasswordThrottled(c, user, input.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+
+	if input.NewPassword == input.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "New password must be different from the current one"})
+		return
+	}
+	if err := utils.ValidatePassword(input.NewPassword, user.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	password, err := utils.HashPassword(input.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error hashing password"})
+		return
+	}
+
+	if err := inits.DB.Model(&user).Updates(map[string]interface{}{
+		"password":             password,
+		"must_change_password": false,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to change password"})
+		return
+	}
+
+	// Sign out every other device and give this one a fresh token pair
+	if err := RevokeAllUserTokens(user.ID, "password changed"); err != nil {
+		log.Printf("Failed to revoke tokens after password change: %v", err)
+	}
+	if err := IssueTokens(c, user); err != nil {
+		log.Printf("Error creating token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
+
 // Unified Update function for user
 func UserUpdate(c *gin.Context) {
 	// Get userID from middleware
@@ -203,15 +330,23 @@ func UserUpdate(c *gin.Context) {
 	// Convert userID to string (if stored as int in context)
 	userIDStr := fmt.Sprintf("%v", userID)
 
-	// Check if the user is a manager
-	isManager := IsUserManager(c)
+	currentUserID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
 
-	// Parse request body for the update
+	// Editing other users and changing the Manager flag need their own permissions
+	canManageUsers := UserHasPermission(currentUserID, models.PermUsersManage)
+	canAssignRoles := UserHasPermission(currentUserID, models.PermRolesAssign)
+
+	// Parse request body for the update, the avatar is changed through UploadAvatar
 	var input struct {
 		Name     string `json:"Name"`
-		ImgPath  string `json:"ImgPath"`
+		Email    string `json:"Email"`
 		UserName string `json:"userName"` // Target user to update, if different from the logged-in user
-		Manager  bool   `json:"Manager"`  // To update manager status (only for managers)
+		Manager  bool   `json:"Manager"`  // To update manager status (needs roles.assign)
+		profileInput
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -228,9 +363,9 @@ func UserUpdate(c *gin.Context) {
 			return
 		}
 	} else {
-		// If updating another user, ensure the logged-in user is a manager
-		if !isManager {
-			c.JSON(http.StatusForbidden, gin.H{"message": "You must be a manager to update another user"})
+		// If updating another user, ensure the logged-in user may manage users
+		if !canManageUsers {
+			c.JSON(http.StatusForbidden, gin.H{"message": "You are not allowed to update another user"})
 			return
 		}
 
@@ -244,33 +379,90 @@ func UserUpdate(c *gin.Context) {
 	// Prepare updates
 	updates := map[string]interface{}{}
 	if len(input.Name) >= 3 && input.Name != targetUser.Name {
-		// Check if the new name is already taken (except for the current user)
+		// Check if the new name is already taken (except for the current user), deactivated accounts keep theirs
 		var existingUser models.User
-		if err := inits.DB.Where("name = ? AND id != ?", input.Name, targetUser.ID).First(&existingUser).Error; err == nil {
-			c.JSON(http.StatusBadRequest, gin.H{"message": "User name already exists"})
+		if err := inits.DB.Unscoped().Where("name = ? AND id != ?", input.Name, targetUser.ID).First(&existingUser).Error; err == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "This name is already taken"})
 			return
 		}
 		updates["Name"] = input.Name
 	}
 
-	if input.ImgPath != "" && input.ImgPath != targetUser.ImgPath {
-		updates["ImgPath"] = input.ImgPath
+	if input.Email != "" {
+		email, err := normalizeEmail(input.Email)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid email address"})
+			return
+		}
+		if email != targetUser.Email {
+			if isEmailTaken(email, targetUser.ID) {
+				c.JSON(http.StatusBadRequest, gin.H{"message": "Email address already in use"})
+				return
+			}
+			// A new address has to be verified again
+			updates["Email"] = email
+			updates["EmailVerified"] = false
+		}
 	}
 
-	// Only allow managers to update "Manager" status
-	if isManager && targetUser.Manager != input.Manager {
-		updates["Manager"] = input.Manager
+	profileUpdates, err := input.profileInput.updates()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	for field, value := range profileUpdates {
+		updates[field] = value
+	}
+
+	// Values before the change, for the audit log
+	before := map[string]interface{}{}
+	for field := range updates {
+		switch field {
+		case "Name":
+			before[field] = targetUser.Name
+		case "Email":
+			before[field] = targetUser.Email
+		case "EmailVerified":
+			before[field] = targetUser.EmailVerified
+		case "DisplayName":
+			before[field] = targetUser.DisplayName
+		case "Bio":
+			before[field] = targetUser.Bio
+		case "Timezone":
+			before[field] = targetUser.Timezone
+		case "Locale":
+			before[field] = targetUser.Locale
+		case "Pronouns":
+			before[field] = targetUser.Pronouns
+		}
 	}
 
-	// If the user is not a manager, they cannot change the "Manager" field
-	if !isManager && input.Manager != targetUser.Manager {
-		// Make sure users cannot change their "Manager" status
-		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot change your Manager status"})
+	// Only users who can assign roles may change the "Manager" status
+	managerChanged := targetUser.Manager != input.Manager
+	if managerChanged && !canAssignRoles {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot change the Manager status"})
 		return
 	}
 
+	if managerChanged {
+		// Manager is the admin role, change the role and let it sync the flag
+		var err error
+		if input.Manager {
+			err = assignRole(&targetUser, models.RoleAdmin)
+		} else if countUsersWithRole(models.RoleAdmin) <= 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot revoke the last admin"})
+			return
+		} else {
+			err = revokeRole(&targetUser, models.RoleAdmin)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to update user"})
+			return
+		}
+	}
+
 	// If there are no changes, return early
-	if len(updates) == 0 {
+	if len(updates) == 0 && !managerChanged {
 		c.JSON(http.StatusOK, gin.H{"message": "No changes detected"})
 		return
 	}
@@ -281,17 +473,30 @@ func UserUpdate(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully", "user": targetUser})
-}
+	// Editing someone else or the Manager flag is privileged, editing yourself is not
+	if targetUser.ID != currentUserID || managerChanged {
+		after := map[string]interface{}{}
+		for field := range before {
+			after[field] = updates[field]
+		}
+		if managerChanged {
+			before["Manager"] = !input.Manager
+			after["Manager"] = input.Manager
+		}
+		Audit(c, "user.update", "user", targetUser.ID, targetUser.Name, before, after)
+	}
 
-// List all users
-func UsersIndex(c *gin.Context) {
-	var users []models.User
-	inits.DB.Find(&users)
+	if email, changed := updates["Email"]; changed {
+		targetUser.Email = email.(string)
+		if err := sendVerificationEmail(targetUser); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+		}
+	}
 
-	c.JSON(http.StatusOK, gin.H{"users": users})
+	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully", "user": targetUser})
 }
 
+// Show a single user by ID
 func UsersShow(c *gin.Context) {
 	// Log the received ID
 	idParam := c.Param("id")
@@ -314,43 +519,99 @@ func UsersShow(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
-// Delete a user
+// Deactivate a user, their data is purged once the grace period is over
 func UsersDelete(c *gin.Context) {
-	if err := c.ShouldBindJSON(&account); err != nil {
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
 		return
 	}
 
-	result := inits.DB.Unscoped().Where("Name = ?", account.Name).Delete(&models.User{})
-
-	if result.RowsAffected == 0 {
+	var user models.User
+	if err := inits.DB.Where("name = ?", input.Name).First(&user).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
 		return
 	}
 
-	c.Status(http.StatusOK)
+	// Never lock everyone out of the admin endpoints
+	if user.Manager && countUsersWithRole(models.RoleAdmin) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot deactivate the last admin"})
+		return
+	}
+
+	if err := deactivateUser(&user, "account deactivated"); err != nil {
+		log.Printf("Failed to deactivate user %s: %v", user.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to deactivate user"})
+		return
+	}
+
+	Audit(c, "user.deactivate", "user", user.ID, user.Name, nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "User deactivated",
+		"purgeAfter": time.Now().Add(purgeGracePeriod()),
+	})
 }
 
 // Make a user a manager
 func UserMakeManager(c *gin.Context) {
-	if err := c.BindJSON(&account); err != nil {
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
 		return
 	}
 
 	var user models.User
-	result := inits.DB.Where("name = ?", account.Name).First(&user)
+	result := inits.DB.Where("name = ?", input.Name).First(&user)
 
 	if result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
 		return
 	}
 
-	inits.DB.Model(&user).Update("Manager", true)
+	wasManager := user.Manager
+	if err := assignRole(&user, models.RoleAdmin); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to make user a manager"})
+		return
+	}
+	Audit(c, "role.assign", "user", user.ID, user.Name, gin.H{"Manager": wasManager}, gin.H{"Manager": true, "role": models.RoleAdmin})
 
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
+// UserUnlock clears the login lockout of an account name and, optionally, an IP address
+func UserUnlock(c *gin.Context) {
+	var input struct {
+		Name string `json:"name"`
+		IP   string `json:"ip"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Name == "" && input.IP == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	if input.Name != "" {
+		if err := clearLoginFailures(accountThrottleKey(input.Name)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to unlock account"})
+			return
+		}
+		Audit(c, "login.unlock", "user", 0, input.Name, nil, nil)
+	}
+	if input.IP != "" {
+		if err := clearLoginFailures(ipThrottleKey(input.IP)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to unlock IP address"})
+			return
+		}
+		Audit(c, "login.unlock", "ip", 0, input.IP, nil, nil)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unlocked"})
+}
+
 // GetUserByName fetches a user by their name from the database
 func GetUserByName(c *gin.Context) {
 	name := c.Param("name") // Extract the username from the URL
@@ -361,5 +622,23 @@ func GetUserByName(c *gin.Context) {
 		return
 	}
 
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	// A user who blocked the caller looks the same as one who does not exist
+	if HasBlocked(user.ID, userID) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	// Only the user themself and admins see the full record, everyone else the public profile
+	if user.ID != userID && !UserHasPermission(userID, models.PermUsersManage) {
+		c.JSON(http.StatusOK, gin.H{"user": user.Public()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
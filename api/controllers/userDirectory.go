@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDirectoryLimit = 20
+	maxDirectoryLimit     = 100
+)
+
+// Set by SetupUserSearch, fuzzy search needs the pg_trgm extension
+var trigramAvailable bool
+
+// SetupUserSearch creates the indexes behind the user directory search
+func SetupUserSearch() {
+	// Prefix search on the lower case name
+	if err := inits.DB.Exec("CREATE INDEX IF NOT EXISTS idx_users_name_prefix ON users (lower(name) text_pattern_ops)").Error; err != nil {
+		log.Printf("Failed to create user name prefix index: %v", err)
+	}
+
+	if err := inits.DB.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("pg_trgm is not available, fuzzy user search is disabled: %v", err)
+		return
+	}
+	if err := inits.DB.Exec("CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING gin (name gin_trgm_ops)").Error; err != nil {
+		log.Printf("Failed to create user name trigram index: %v", err)
+		return
+	}
+	trigramAvailable = true
+}
+
+// Position after the last row of a page, handed to the client as an opaque string
+type directoryCursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func encodeDirectoryCursor(cursor directoryCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeDirectoryCursor(s string) (*directoryCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cursor directoryCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == 0 {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// Parses an RFC 3339 time or a plain date
+func parseDirectoryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// Escapes the LIKE wildcards in user input
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// A directory row, with the search relevance when searching fuzzily
+type directoryRow struct {
+	models.User
+	Score float32
+}
+
+// UsersIndex lists users page by page, with optional search, filters and sorting
+//
+// Query parameters:
+//
+//	q             name to search for
+//	match         "prefix" (default) or "fuzzy"
+//	role          only users holding this role
+//	createdAfter  only users created after this time (RFC 3339 or YYYY-MM-DD)
+//	createdBefore only users created before this time
+//	sort          name, -name, created, -created or relevance (default for fuzzy search)
+//	limit         page size, at most 100
+//	cursor        nextCursor of the previous page
+func UsersIndex(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	match := c.DefaultQuery("match", "prefix")
+	if match != "prefix" && match != "fuzzy" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "match must be prefix or fuzzy"})
+		return
+	}
+	fuzzy := match == "fuzzy" && q != ""
+	if fuzzy && !trigramAvailable {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Fuzzy search is not available"})
+		return
+	}
+
+	sort := c.Query("sort")
+	if sort == "" {
+		sort = "name"
+		if fuzzy {
+			sort = "relevance"
+		}
+	}
+
+	limit := defaultDirectoryLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit"})
+			return
+		}
+		if n > maxDirectoryLimit {
+			n = maxDirectoryLimit
+		}
+		limit = n
+	}
+
+	query := inits.DB.Model(&models.User{}).Select("users.*")
+
+	// Users who blocked the caller are left out, as if they did not exist
+	if userID, err := GetValidUserID(c); err == nil {
+		query = query.Where("users.id NOT IN (?)", inits.DB.Model(&models.Block{}).Select("user_id").Where("blocked_id = ?", userID))
+	}
+
+	if q != "" {
+		if fuzzy {
+			// % uses the trigram index, the similarity is returned for ranking
+			query = query.Select("users.*, similarity(users.name, ?) AS score", q).Where("users.name % ?", q)
+		} else {
+			query = query.Where(`lower(users.name) LIKE ? ESCAPE '\'`, strings.ToLower(escapeLike(q))+"%")
+		}
+	}
+
+	if role := c.Query("role"); role != "" {
+		query = query.Where("users.id IN (?)", inits.DB.Table("user_roles").
+			Select("user_roles.user_id").
+			Joins("JOIN roles ON roles.id = user_roles.role_id").
+			Where("roles.name = ?", role))
+	}
+
+	if after := c.Query("createdAfter"); after != "" {
+		t, err := parseDirectoryTime(after)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid createdAfter"})
+			return
+		}
+		query = query.Where("users.created_at > ?", t)
+	}
+	if before := c.Query("createdBefore"); before != "" {
+		t, err := parseDirectoryTime(before)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid createdBefore"})
+			return
+		}
+		query = query.Where("users.created_at < ?", t)
+	}
+
+	// Keyset pagination: every sort ends with the id so the order is total
+	var cursor *directoryCursor
+	if s := c.Query("cursor"); s != "" {
+		var err error
+		if cursor, err = decodeDirectoryCursor(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	var cursorValue func(row directoryRow) string
+	switch sort {
+	case "name", "-name":
+		op, dir := ">", "ASC"
+		if sort == "-name" {
+			op, dir = "<", "DESC"
+		}
+		if cursor != nil {
+			query = query.Where("(users.name, users.id) "+op+" (?, ?)", cursor.Value, cursor.ID)
+		}
+		query = query.Order("users.name " + dir).Order("users.id " + dir)
+		cursorValue = func(row directoryRow) string { return row.Name }
+	case "created", "-created":
+		op, dir := ">", "ASC"
+		if sort == "-created" {
+			op, dir = "<", "DESC"
+		}
+		if cursor != nil {
+			t, err := time.Parse(time.RFC3339Nano, cursor.Value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": "invalid cursor"})
+				return
+			}
+			query = query.Where("(users.created_at, users.id) "+op+" (?, ?)", t, cursor.ID)
+		}
+		query = query.Order("users.created_at " + dir).Order("users.id " + dir)
+		cursorValue = func(row directoryRow) string { return row.CreatedAt.Format(time.RFC3339Nano) }
+	case "relevance":
+		if !fuzzy {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "relevance sorting needs a fuzzy search"})
+			return
+		}
+		if cursor != nil {
+			score, err := strconv.ParseFloat(cursor.Value, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": "invalid cursor"})
+				return
+			}
+			query = query.Where("(similarity(users.name, ?), users.id) < (?::real, ?)", q, score, cursor.ID)
+		}
+		query = query.Order("score DESC").Order("users.id DESC")
+		cursorValue = func(row directoryRow) string {
+			return strconv.FormatFloat(float64(row.Score), 'g', -1, 32)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "sort must be name, -name, created, -created or relevance"})
+		return
+	}
+
+	// One extra row tells us whether there is another page
+	var rows []directoryRow
+	if err := query.Limit(limit + 1).Find(&rows).Error; err != nil {
+		log.Printf("Failed to list users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error fetching users"})
+		return
+	}
+
+	nextCursor := ""
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		nextCursor = encodeDirectoryCursor(directoryCursor{Value: cursorValue(last), ID: last.ID})
+	}
+
+	users := make([]models.PublicUser, 0, len(rows))
+	for _, row := range rows {
+		users = append(users, row.Public())
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "nextCursor": nextCursor})
+}
@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/userhub"
+	"yuval/websocket2"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errNotModerator = errors.New("only the host or a co-host can do this")
+	errNotWaiting   = errors.New("this user is not in the waiting room")
+)
+
+// IsSessionModerator reports whether the user hosts or co-hosts the session
+func IsSessionModerator(session models.Session, userID uint) bool {
+	if session.HostID == userID {
+		return true
+	}
+	var count int64
+	inits.DB.Model(&models.SessionCoHost{}).Where("session_id = ? AND user_id = ?", session.ID, userID).Count(&count)
+	return count > 0
+}
+
+// Host and co-hosts of a session
+func sessionModerators(session models.Session) []uint {
+	moderators := []uint{session.HostID}
+	var coHosts []uint
+	inits.DB.Model(&models.SessionCoHost{}).Where("session_id = ?", session.ID).Pluck("user_id", &coHosts)
+	return append(moderators, coHosts...)
+}
+
+type waitingUser struct {
+	User  models.PublicUser `json:"user"`
+	Since time.Time         `json:"since"`
+}
+
+func waitingUsers(sessionID uint) []waitingUser {
+	var entries []models.WaitingRoomEntry
+	inits.DB.Where("session_id = ? AND status = ?", sessionID, models.WaitingPending).Order("updated_at").Find(&entries)
+
+	waiting := make([]waitingUser, 0, len(entries))
+	for _, entry := range entries {
+		var user models.User
+		if err := inits.DB.First(&user, entry.UserID).Error; err != nil {
+			continue
+		}
+		waiting = append(waiting, waitingUser{User: user.Public(), Since: entry.UpdatedAt})
+	}
+	return waiting
+}
+
+// Sends the current waiting room to the moderators in the meeting
+func pushWaitingRoom(session models.Session) {
+	websocket2.SendToSessionUsers(session.ID, sessionModerators(session), gin.H{"type": "waiting_room", "waiting": waitingUsers(session.ID)})
+}
+
+// Puts a user in the waiting room, or back in it after they were rejected
+func enterWaitingRoom(session models.Session, userID uint) error {
+	entry := models.WaitingRoomEntry{SessionID: session.ID, UserID: userID}
+	inits.DB.Where(entry).First(&entry)
+	entry.Status = models.WaitingPending
+	entry.DecidedBy = nil
+	entry.DecidedAt = nil
+	if err := inits.DB.Save(&entry).Error; err != nil {
+		return fmt.Errorf("failed to enter the waiting room: %v", err)
+	}
+
+	pushWaitingRoom(session)
+	return nil
+}
+
+// Returns whether a moderator already admitted the user to the session
+func admittedFromWaitingRoom(sessionID, userID uint) bool {
+	var count int64
+	inits.DB.Model(&models.WaitingRoomEntry{}).
+		Where("session_id = ? AND user_id = ? AND status = ?", sessionID, userID, models.WaitingAdmitted).
+		Count(&count)
+	return count > 0
+}
+
+// Admits or rejects a waiting user, shared by the REST endpoints and the websocket commands
+func decideWaiting(session models.Session, moderatorID, userID uint, admit bool) error {
+	if !IsSessionModerator(session, moderatorID) {
+		return errNotModerator
+	}
+
+	var entry models.WaitingRoomEntry
+	if err := inits.DB.Where("session_id = ? AND user_id = ? AND status = ?", session.ID, userID, models.WaitingPending).First(&entry).Error; err != nil {
+		return errNotWaiting
+	}
+
+	status, event := models.WaitingRejected, "waiting_room_rejected"
+	if admit {
+		status, event = models.WaitingAdmitted, "waiting_room_admitted"
+	}
+	now := time.Now()
+	if err := inits.DB.Model(&entry).Updates(map[string]interface{}{"status": status, "decided_by": moderatorID, "decided_at": now}).Error; err != nil {
+		return fmt.Errorf("failed to update the waiting room: %v", err)
+	}
+
+	if admit {
+		if err := CreateUserSession(userID, session.ID); err != nil {
+			return err
+		}
+		websocket2.BroadcastMessage(session.ID, fmt.Sprintf("User %d has joined the session %s", userID, session.Name))
+	}
+
+	userhub.SendToUser(userID, gin.H{"type": event, "session": session.Name, "sessionId": session.ID})
+	pushWaitingRoom(session)
+	return nil
+}
+
+// Loads the session named in the URL for a moderator, responding itself on failure
+func moderatedSession(c *gin.Context) (models.Session, uint, bool) {
+	var session models.Session
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return session, 0, false
+	}
+	if err := inits.DB.Where("name = ?", c.Param("id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Session not found"})
+		return session, 0, false
+	}
+	if !IsSessionModerator(session, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only the host or a co-host can do this"})
+		return session, 0, false
+	}
+	return session, userID, true
+}
+
+// ListWaitingRoom shows the host and co-hosts who is waiting to join
+func ListWaitingRoom(c *gin.Context) {
+	session, _, ok := moderatedSession(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"waiting": waitingUsers(session.ID)})
+}
+
+func decideWaitingHandler(c *gin.Context, admit bool) {
+	session, moderatorID, ok := moderatedSession(c)
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Where("name = ?", c.Param("name")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if err := decideWaiting(session, moderatorID, user.ID, admit); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotWaiting) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"message": err.Error()})
+		return
+	}
+
+	if admit {
+		c.JSON(http.StatusOK, gin.H{"message": "User admitted"})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "User rejected"})
+	}
+}
+
+// AdmitWaitingUser lets a waiting user into the session
+func AdmitWaitingUser(c *gin.Context) {
+	decideWaitingHandler(c, true)
+}
+
+// RejectWaitingUser turns a waiting user away, they may ask to join again
+func RejectWaitingUser(c *gin.Context) {
+	decideWaitingHandler(c, false)
+}
+
+// LeaveWaitingRoom stops the authenticated user waiting to join a session
+func LeaveWaitingRoom(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	var session models.Session
+	if err := inits.DB.Where("name = ?", c.Param("id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Session not found"})
+		return
+	}
+
+	result := inits.DB.Unscoped().Where("session_id = ? AND user_id = ? AND status = ?", session.ID, userID, models.WaitingPending).Delete(&models.WaitingRoomEntry{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to leave the waiting room"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "You are not in the waiting room"})
+		return
+	}
+	pushWaitingRoom(session)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left the waiting room"})
+}
+
+func waitingRoomCommand(admit bool) websocket2.CommandHandler {
+	return func(userID, sessionID uint, payload json.RawMessage) error {
+		var input struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(payload, &input); err != nil || input.Name == "" {
+			return errors.New("a name is required")
+		}
+
+		var session models.Session
+		if err := inits.DB.First(&session, sessionID).Error; err != nil {
+			return errors.New("session not found")
+		}
+		var user models.User
+		if err := inits.DB.Where("name = ?", input.Name).First(&user).Error; err != nil {
+			return errors.New("user not found")
+		}
+		return decideWaiting(session, userID, user.ID, admit)
+	}
+}
+
+// AdmitCommand is the websocket command {"type": "admit", "name": "..."}
+var AdmitCommand = waitingRoomCommand(true)
+
+// RejectCommand is the websocket command {"type": "reject", "name": "..."}
+var RejectCommand = waitingRoomCommand(false)
+
+// SetCoHost makes a user a co-host of a session the authenticated user hosts
+func SetCoHost(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	session, ok := hostedSession(c, userID)
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Where("name = ?", c.Param("name")).First(&user).Error; err != nil || IsBlocked(userID, user.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if user.ID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You already host this session"})
+		return
+	}
+
+	coHost := models.SessionCoHost{SessionID: session.ID, UserID: user.ID}
+	if err := inits.DB.Where(coHost).FirstOrCreate(&coHost).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to add co-host"})
+		return
+	}
+	// The new co-host needs the waiting room if they are in the meeting
+	pushWaitingRoom(session)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Co-host added"})
+}
+
+// RemoveCoHost takes co-host rights away again
+func RemoveCoHost(c *gin.Context) {
+	userID, err := GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	session, ok := hostedSession(c, userID)
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := inits.DB.Unscoped().Where("name = ?", c.Param("name")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	result := inits.DB.Unscoped().Where("session_id = ? AND user_id = ?", session.ID, user.ID).Delete(&models.SessionCoHost{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to remove co-host"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "This user is not a co-host"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Co-host removed"})
+}
@@ -8,8 +8,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"yuval/controllers"
-	"yuval/utils"
+	"yuval/models"
+	"yuval/pipelines"
 	"yuval/websocket2"
 
 	"github.com/gin-gonic/gin"
@@ -22,23 +24,18 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// HandleWebsocket receives a user's media and feeds it to ffmpeg. The caller proves who
+// they are with an ingest token from POST /sessions/ingest-token, checked before anything starts.
 func HandleWebsocket(w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.URL.Query().Get("userID")
-	if userIDStr == "" {
-		http.Error(w, "Missing userID", http.StatusBadRequest)
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing ingest token", http.StatusUnauthorized)
 		return
 	}
 
-	userIDUint, err := strconv.ParseUint(userIDStr, 10, 32)
+	userID, sessionID, err := controllers.ParseIngestToken(token)
 	if err != nil {
-		http.Error(w, "Invalid userID", http.StatusBadRequest)
-		return
-	}
-	userID := uint(userIDUint)
-
-	sessionID, _, err := controllers.GetSessionByUserID(userID)
-	if err != nil {
-		http.Error(w, "Session not found: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
@@ -76,13 +73,18 @@ func HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cmd.Stderr = log.Writer()
-	go func() {
-		err = cmd.Start()
-		if err != nil {
-			log.Println("Failed to start ffmpeg:", err)
-			return
-		}
-	}()
+	if err := cmd.Start(); err != nil {
+		log.Println("Failed to start ffmpeg:", err)
+		return
+	}
+
+	// Removing the user or ending the meeting stops the pipeline from outside
+	untrack := pipelines.Track(sessionID, userID, func() {
+		conn.Close()
+		cmd.Process.Kill()
+	})
+	defer untrack()
+
 	go func() {
 		ConvertToMPEGDASH(sessionID, userID)
 	}()
@@ -118,19 +120,32 @@ func ConvertToMPEGDASH(sessionID uint, userID uint) {
 		return
 	}
 
-	// FFmpeg command to listen to multicast MPEG-TS and convert to MPEG-DASH
+	// FFmpeg command to listen to multicast MPEG-TS and convert to MPEG-DASH.
+	// Run directly rather than through a shell so stopping the pipeline stops ffmpeg itself.
 	multicastIp := controllers.GenerateMulticastIP(userID)
-	cmd := fmt.Sprintf(
-		`ffmpeg -re -i udp://%s:55 -codec:v libx264 -preset ultrafast -tune zerolatency -codec:a aac -b:a 128k -f dash -seg_duration 1 -window_size 5 -extra_window_size 5 -remove_at_exit 0 %s/stream.mpd`,
-
-		// `ffmpeg -re -i udp://%s:55 -preset ultrafast -tune zerolatency -c copy -f dash -seg_duration 1 -window_size 5 -extra_window_size 5 -remove_at_exit 0 -use_template 1 -use_timeline 1 %s/stream.mpd`,
-		multicastIp, dashOutputDir)
+	cmd := exec.Command("ffmpeg",
+		"-re", "-i", fmt.Sprintf("udp://%s:55", multicastIp),
+		"-codec:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-codec:a", "aac", "-b:a", "128k",
+		"-f", "dash", "-seg_duration", "1", "-window_size", "5", "-extra_window_size", "5", "-remove_at_exit", "0",
+		// "-c", "copy", "-use_template", "1", "-use_timeline", "1",
+		filepath.Join(dashOutputDir, "stream.mpd"),
+	)
+	cmd.Stderr = log.Writer()
+	if err := cmd.Start(); err != nil {
+		log.Println("Failed to start DASH conversion:", err)
+		return
+	}
+	untrack := pipelines.Track(sessionID, userID, func() { cmd.Process.Kill() })
 
 	// Broadcast to all clients in the session that a new user has joined
 	websocket2.BroadcastMessage(sessionID, "stream started")
 	// Run conversion in a goroutine to allow immediate HTTP response
 	go func() {
-		_ = utils.RunCommand(cmd)
+		defer untrack()
+		if err := cmd.Wait(); err != nil {
+			log.Printf("DASH conversion for user %d in session %d exited: %v", userID, sessionID, err)
+		}
 		// Broadcast to all clients in the session that a new user has joined
 		// message := fmt.Sprintf("Dash is ready for %d", userID)
 		// websocket2.BroadcastMessage(sessionID, message)
@@ -153,11 +168,46 @@ func ServeDashFile(c *gin.Context) {
 		return
 	}
 
+	serveSessionMedia(c, requestData.SessionID, requestData.UserID, requestData.FileName)
+}
+
+// ServeSessionMedia serves the DASH files under /uploads/:session/:user/dash, which used to be public
+func ServeSessionMedia(c *gin.Context) {
+	sessionID, errSession := strconv.ParseUint(c.Param("session"), 10, 32)
+	ownerID, errUser := strconv.ParseUint(c.Param("user"), 10, 32)
+	if errSession != nil || errUser != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	serveSessionMedia(c, uint(sessionID), uint(ownerID), c.Param("file"))
+}
+
+// Serves one DASH file of a user in a session to the attendees of that session
+func serveSessionMedia(c *gin.Context, sessionID, ownerID uint, fileName string) {
+	// Only users who may see the session, or users allowed to view all recordings, may fetch its media
+	userID, err := controllers.GetValidUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if !controllers.CanSeeSession(sessionID, userID) &&
+		!controllers.UserHasPermission(userID, models.PermRecordingsViewAll) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to view this recording"})
+		return
+	}
+
+	// The file name must stay inside the user's dash directory
+	if fileName == "" || strings.Contains(fileName, "..") || strings.ContainsAny(fileName, "/\\") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+		return
+	}
+
 	// Construct the file path based on the sessionID, userID, and fileName
-	filePath := filepath.Join("./uploads", fmt.Sprintf("%d", requestData.SessionID), fmt.Sprintf("%d", requestData.UserID), "dash", requestData.FileName)
+	filePath := filepath.Join("./uploads", fmt.Sprintf("%d", sessionID), fmt.Sprintf("%d", ownerID), "dash", fileName)
 
 	// Check if the file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if info, err := os.Stat(filePath); err != nil || info.IsDir() {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
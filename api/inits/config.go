@@ -12,4 +12,35 @@ func InitConfig() {
 	if err != nil {             // Handle errors reading the config file
 		panic("failed to read config file")
 	}
+
+	viper.SetDefault("server.publicUrl", "https://localhost:3000")
+	viper.SetDefault("auth.accessTokenMinutes", 15)
+	viper.SetDefault("auth.refreshTokenHours", 24*7)
+	viper.SetDefault("login.maxAttempts", 5)
+	viper.SetDefault("login.ipMaxAttempts", 20)
+	viper.SetDefault("login.failureWindowMinutes", 15)
+	viper.SetDefault("login.baseLockoutSeconds", 30)
+	viper.SetDefault("login.maxLockoutMinutes", 60)
+	viper.SetDefault("password.minLength", 8)
+	viper.SetDefault("twoFactor.issuer", "My Zoom")
+	viper.SetDefault("oidc.scopes", []string{"openid", "profile", "email"})
+	viper.SetDefault("mail.driver", "log")
+	viper.SetDefault("email.verifyTokenHours", 24)
+	viper.SetDefault("email.resetTokenMinutes", 30)
+	viper.SetDefault("rbac.defaultRoles", []string{"member", "host"})
+	viper.SetDefault("users.purgeGraceDays", 30)
+	viper.SetDefault("users.purgeIntervalMinutes", 60)
+	viper.SetDefault("exports.ttlHours", 48)
+	viper.SetDefault("exports.pendingTimeoutMinutes", 30)
+	viper.SetDefault("presence.awayMinutes", 5)
+	viper.SetDefault("presence.heartbeatTimeoutSeconds", 90)
+	viper.SetDefault("avatar.maxBytes", 5*1024*1024)
+	viper.SetDefault("avatar.maxDimension", 4096)
+	viper.SetDefault("import.maxRows", 500)
+	viper.SetDefault("ingest.tokenSeconds", 60)
+	viper.SetDefault("sessions.passcodeMaxAttempts", 5)
+	viper.SetDefault("notifications.retentionDays", 90)
+	viper.SetDefault("suggestions.meetingWeight", 3)
+	viper.SetDefault("suggestions.overlapHourWeight", 1)
+	viper.SetDefault("suggestions.mutualFriendWeight", 2)
 }
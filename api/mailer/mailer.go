@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Sender delivers a plain text email.
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPSender sends mail through an SMTP server, e.g. a local MailHog catcher.
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(to, subject, body string) error {
+	// The From header keeps the display name, the envelope takes only the address
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %v", s.From, err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + from.String(),
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	if err := smtp.SendMail(addr, auth, from.Address, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %v", to, err)
+	}
+	return nil
+}
+
+// LogSender only logs the mail, for development without an SMTP server.
+type LogSender struct{}
+
+func (LogSender) Send(to, subject, body string) error {
+	log.Printf("Mail to %s\nSubject: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+// Mailer is the sender used by the application, chosen by mail.driver.
+var Mailer Sender = LogSender{}
+
+func InitMailer() {
+	switch viper.GetString("mail.driver") {
+	case "smtp":
+		Mailer = SMTPSender{
+			Host:     viper.GetString("mail.host"),
+			Port:     viper.GetInt("mail.port"),
+			Username: viper.GetString("mail.username"),
+			Password: viper.GetString("mail.password"),
+			From:     viper.GetString("mail.from"),
+		}
+	default:
+		Mailer = LogSender{}
+	}
+}
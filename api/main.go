@@ -7,8 +7,11 @@ import (
 	"yuval/controllers"
 	"yuval/dasher"
 	"yuval/inits"
+	"yuval/mailer"
 	"yuval/middleware"
 	"yuval/models"
+	"yuval/oidc"
+	"yuval/userhub"
 	"yuval/websocket2" // Import WebSocket package
 
 	"github.com/gin-contrib/cors"
@@ -19,7 +22,14 @@ import (
 func init() {
 	inits.InitConfig()
 	inits.ConnectToDB()
-	inits.DB.AutoMigrate(&models.User{}, &models.Session{}, &models.UserSession{}, &models.Friend{}) // Ensure you migrate all relevant models
+	mailer.InitMailer()
+	oidc.InitOIDC()
+	inits.DB.AutoMigrate(&models.User{}, &models.Session{}, &models.UserSession{}, &models.Friend{}, &models.AuthToken{}, &models.RevokedToken{}, &models.APIKey{}, &models.Role{}, &models.Permission{}, &models.LoginThrottle{}, &models.UserToken{}, &models.RecoveryCode{}, &models.ExternalIdentity{}, &models.DataExport{}, &models.UserPreferences{}, &models.UserStatus{}, &models.AuditLog{}, &models.Block{}, &models.Notification{}, &models.SuggestionDismissal{}, &models.ContactGroup{}, &models.ContactGroupMember{}, &models.Favorite{}, &models.SessionInvitation{}, &models.SessionCoHost{}, &models.WaitingRoomEntry{}, &models.SessionBan{}) // Ensure you migrate all relevant models
+	controllers.SeedRoles()
+	controllers.SyncFriendStatus()
+	controllers.SetupPreferences()
+	controllers.SetupUserSearch()
+	controllers.SetupAuditLog()
 }
 
 func main() {
@@ -33,7 +43,7 @@ func main() {
 		AllowOriginFunc: func(origin string) bool {
 			return true // Allow all origins dynamically
 		},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		AllowCredentials: true,
 	}))
@@ -41,8 +51,28 @@ func main() {
 	// Initialize WebSocket Hub and start handling messages
 	go websocket2.HandleMessages()
 
+	// Commands moderators send over the meeting websocket
+	websocket2.RegisterCommand("admit", controllers.AdmitCommand)
+	websocket2.RegisterCommand("reject", controllers.RejectCommand)
+	websocket2.RegisterCommand("mute", controllers.MuteCommand)
+	websocket2.RegisterCommand("video_off", controllers.VideoOffCommand)
+	websocket2.RegisterCommand("remove", controllers.RemoveCommand)
+	websocket2.RegisterCommand("lock", controllers.LockCommand)
+	websocket2.RegisterCommand("end", controllers.EndCommand)
+
+	// Periodically drop expired tokens from the token store
+	go controllers.StartTokenPruner()
+
+	// Purge deactivated users once their grace period is over
+	go controllers.StartUserPurger()
+
+	// Recompute presence so idle users turn away and manual statuses expire
+	go userhub.Run()
+
 	// WebSocket2 route
 	r.GET("/ws", middleware.AuthMiddleware(), websocket2.HandleConnections)
+	// User-level websocket for presence, independent of sessions
+	r.GET("/ws/user", middleware.AuthMiddleware(), userhub.HandleConnections)
 
 	go func() {
 		http.HandleFunc("/b", dasher.HandleWebsocket)
@@ -51,33 +81,111 @@ func main() {
 
 	// Public routes
 	r.POST("/users/login", controllers.Login)
+	r.POST("/users/login/2fa", controllers.LoginTwoFactor)
 	r.POST("/users/signup", controllers.UsersCreate)
+	r.GET("/users/oidc/login", controllers.OIDCLogin)
+	r.GET("/users/oidc/callback", controllers.OIDCCallback)
+	r.POST("/users/refresh", controllers.RefreshTokens)
+	r.POST("/users/email/verify", controllers.VerifyEmail)
+	r.POST("/users/password/forgot", controllers.ForgotPassword)
+	r.POST("/users/password/reset", controllers.ResetPassword)
 
 	// Protected user routes (Require authentication)
 	r.GET("/users", middleware.AuthMiddleware(), controllers.UsersIndex)
 	r.PUT("/users/update", middleware.AuthMiddleware(), controllers.UserUpdate)
+	r.PUT("/users/password", middleware.AuthMiddleware(), controllers.ChangePassword)
 	r.GET("/users/cookie", middleware.AuthMiddleware(), controllers.User)
 	r.POST("/users/logout", middleware.AuthMiddleware(), controllers.LogOut)
+	r.POST("/users/logout/all", middleware.AuthMiddleware(), controllers.LogOutEverywhere)
+	r.POST("/users/email/verify/send", middleware.AuthMiddleware(), controllers.SendVerificationEmail)
+	r.POST("/users/2fa/enroll", middleware.AuthMiddleware(), controllers.EnrollTwoFactor)
+	r.POST("/users/2fa/confirm", middleware.AuthMiddleware(), controllers.ConfirmTwoFactor)
+	r.POST("/users/2fa/recovery-codes", middleware.AuthMiddleware(), controllers.RegenerateRecoveryCodes)
+	r.DELETE("/users/2fa", middleware.AuthMiddleware(), controllers.DisableTwoFactor)
+	r.GET("/users/keys", middleware.AuthMiddleware(), controllers.ListAPIKeys)
+	r.POST("/users/keys", middleware.AuthMiddleware(), controllers.CreateAPIKey)
+	r.DELETE("/users/keys/:id", middleware.AuthMiddleware(), controllers.RevokeAPIKey)
+	r.GET("/users/me/export", middleware.AuthMiddleware(), controllers.RequestDataExport)
+	r.GET("/users/me/export/:id/download", middleware.AuthMiddleware(), controllers.DownloadDataExport)
+	r.GET("/users/me/preferences", middleware.AuthMiddleware(), controllers.GetPreferences)
+	r.PATCH("/users/me/preferences", middleware.AuthMiddleware(), controllers.UpdatePreferences)
+	r.GET("/users/me/status", middleware.AuthMiddleware(), controllers.GetStatus)
+	r.PUT("/users/me/status", middleware.AuthMiddleware(), controllers.SetStatus)
+	r.DELETE("/users/me/status", middleware.AuthMiddleware(), controllers.ClearStatus)
+	r.DELETE("/users/me", middleware.AuthMiddleware(), controllers.DeleteOwnAccount)
+	r.GET("/users/blocks", middleware.AuthMiddleware(), controllers.ListBlocks)
+	r.POST("/users/blocks", middleware.AuthMiddleware(), controllers.BlockUser)
+	r.DELETE("/users/blocks/:name", middleware.AuthMiddleware(), controllers.UnblockUser)
 	r.GET("/users/:name", middleware.AuthMiddleware(), controllers.GetUserByName)
 
 	r.GET("/friends/all", middleware.AuthMiddleware(), controllers.GetFriends)
 	r.POST("/friends/add", middleware.AuthMiddleware(), controllers.AddFriend)
 	r.POST("/friends/accept", middleware.AuthMiddleware(), controllers.AcceptFriendship)
 	r.DELETE("/friends/delete", middleware.AuthMiddleware(), controllers.DeleteFriend)
+	r.POST("/friends/decline", middleware.AuthMiddleware(), controllers.DeclineFriendship)
+	r.POST("/friends/cancel", middleware.AuthMiddleware(), controllers.CancelFriendRequest)
+	r.GET("/friends/suggestions", middleware.AuthMiddleware(), controllers.FriendSuggestions)
+	r.POST("/friends/suggestions/dismiss", middleware.AuthMiddleware(), controllers.DismissSuggestion)
+	r.GET("/friends/groups", middleware.AuthMiddleware(), controllers.ListContactGroups)
+	r.POST("/friends/groups", middleware.AuthMiddleware(), controllers.CreateContactGroup)
+	r.PUT("/friends/groups/order", middleware.AuthMiddleware(), controllers.ReorderContactGroups)
+	r.PATCH("/friends/groups/:id", middleware.AuthMiddleware(), controllers.RenameContactGroup)
+	r.DELETE("/friends/groups/:id", middleware.AuthMiddleware(), controllers.DeleteContactGroup)
+	r.POST("/friends/groups/:id/members", middleware.AuthMiddleware(), controllers.AddGroupMembers)
+	r.DELETE("/friends/groups/:id/members", middleware.AuthMiddleware(), controllers.RemoveGroupMembers)
+	r.PUT("/friends/favorites/:name", middleware.AuthMiddleware(), controllers.SetFavorite)
+	r.DELETE("/friends/favorites/:name", middleware.AuthMiddleware(), controllers.SetFavorite)
+	r.GET("/notifications", middleware.AuthMiddleware(), controllers.ListNotifications)
+	r.GET("/notifications/unread-count", middleware.AuthMiddleware(), controllers.UnreadNotificationCount)
+	r.POST("/notifications/read", middleware.AuthMiddleware(), controllers.MarkNotificationsRead)
 
 	// Session routes (Require authentication)
-	r.POST("/sessions/create", middleware.AuthMiddleware(), controllers.CreateSession)
+	r.POST("/sessions/create", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermSessionsCreate), controllers.CreateSession)
 	r.POST("/sessions/join", middleware.AuthMiddleware(), controllers.JoinSession)
+	r.POST("/sessions/ingest-token", middleware.AuthMiddleware(), controllers.CreateIngestToken)
+	r.GET("/sessions/invitations", middleware.AuthMiddleware(), controllers.MyInvitations)
+	r.POST("/sessions/invitations/:id/accept", middleware.AuthMiddleware(), controllers.AcceptInvitation)
+	r.POST("/sessions/invitations/:id/decline", middleware.AuthMiddleware(), controllers.DeclineInvitation)
 	r.GET("/sessions/:id", middleware.AuthMiddleware(), controllers.GetSessionDetails) // Fetch session details and participants
-
-	r.Static("/uploads", "./uploads")
+	r.GET("/sessions/:id/invitations", middleware.AuthMiddleware(), controllers.ListSessionInvitations)
+	r.POST("/sessions/:id/invitations", middleware.AuthMiddleware(), controllers.InviteToSession)
+	r.PATCH("/sessions/:id", middleware.AuthMiddleware(), controllers.UpdateSessionSettings)
+	r.PUT("/sessions/:id/cohosts/:name", middleware.AuthMiddleware(), controllers.SetCoHost)
+	r.DELETE("/sessions/:id/cohosts/:name", middleware.AuthMiddleware(), controllers.RemoveCoHost)
+	r.GET("/sessions/:id/waiting", middleware.AuthMiddleware(), controllers.ListWaitingRoom)
+	r.DELETE("/sessions/:id/waiting", middleware.AuthMiddleware(), controllers.LeaveWaitingRoom)
+	r.POST("/sessions/:id/waiting/:name/admit", middleware.AuthMiddleware(), controllers.AdmitWaitingUser)
+	r.POST("/sessions/:id/waiting/:name/reject", middleware.AuthMiddleware(), controllers.RejectWaitingUser)
+	r.POST("/sessions/:id/participants/:name/mute", middleware.AuthMiddleware(), controllers.MuteParticipant)
+	r.POST("/sessions/:id/participants/:name/video-off", middleware.AuthMiddleware(), controllers.StopParticipantVideo)
+	r.POST("/sessions/:id/participants/:name/remove", middleware.AuthMiddleware(), controllers.RemoveParticipant)
+	r.DELETE("/sessions/:id/bans/:name", middleware.AuthMiddleware(), controllers.LiftSessionBan)
+	r.POST("/sessions/:id/lock", middleware.AuthMiddleware(), controllers.LockSession)
+	r.POST("/sessions/:id/end", middleware.AuthMiddleware(), controllers.EndSessionForAll)
+
+	r.POST("/users/avatar", middleware.AuthMiddleware(), controllers.UploadAvatar)
+	// Avatars are public, session media is only for the attendees
+	r.Static("/uploads/avatars", "./uploads/avatars")
+	r.GET("/uploads/:session/:user/dash/:file", middleware.AuthMiddleware(), dasher.ServeSessionMedia)
+	r.HEAD("/uploads/:session/:user/dash/:file", middleware.AuthMiddleware(), dasher.ServeSessionMedia)
 
 	// r.POST("/video/upload", middleware.AuthMiddleware(), controllers.ConvertToMPEGTS)
 	r.POST("/video/stream", middleware.AuthMiddleware(), dasher.ServeDashFile)
 
-	// Admin routes (Require both authentication & manager check)
-	r.DELETE("/users/delete", middleware.AuthMiddleware(), middleware.ManagerMiddlewar(), controllers.UsersDelete)
-	r.PUT("/users/manager", middleware.AuthMiddleware(), middleware.ManagerMiddlewar(), controllers.UserMakeManager)
+	// Admin routes (Require both authentication & the matching permission)
+	r.DELETE("/users/delete", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersDelete), controllers.UsersDelete)
+	r.POST("/users/reactivate", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersDelete), controllers.UserReactivate)
+	r.POST("/admin/users/import", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersImport), controllers.ImportUsers)
+	r.POST("/admin/users/purge", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersDelete), controllers.PurgeUser)
+	r.PUT("/users/manager", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermRolesAssign), controllers.UserMakeManager)
+	r.POST("/users/revoke", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersDelete), controllers.UserRevokeTokens)
+	r.POST("/users/unlock", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersUnlock), controllers.UserUnlock)
+	r.PUT("/admin/2fa/managers", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermUsersSecurity), controllers.RequireTwoFactorForManagers)
+	r.GET("/roles", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermRolesAssign), controllers.ListRoles)
+	r.GET("/admin/audit", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermAuditView), controllers.ListAuditLog)
+	r.GET("/admin/audit/export", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermAuditView), controllers.ExportAuditLog)
+	r.POST("/users/roles", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermRolesAssign), controllers.UserAssignRole)
+	r.DELETE("/users/roles", middleware.AuthMiddleware(), middleware.PermissionMiddleware(models.PermRolesAssign), controllers.UserRevokeRole)
 
 	// Start server
 	port := viper.GetInt("server.port")
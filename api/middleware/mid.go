@@ -3,12 +3,18 @@ package middleware
 import (
 	"net/http"
 	"yuval/controllers"
-	"yuval/inits"
-	"yuval/models"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Routes still open to a user who has to replace a temporary password
+var passwordChangeRoutes = map[string]bool{
+	"/users/password":   true,
+	"/users/logout":     true,
+	"/users/logout/all": true,
+	"/users/cookie":     true,
+}
+
 // AuthMiddleware ensures the user is authenticated.
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -19,6 +25,20 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// API keys may be limited to a subset of the routes
+		if !controllers.HasRequiredScope(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key is missing the required scope"})
+			c.Abort()
+			return
+		}
+
+		// Accounts with a temporary password can only change it or sign out
+		if controllers.MustChangePassword(userID) && !passwordChangeRoutes[c.FullPath()] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Password change required", "mustChangePassword": true})
+			c.Abort()
+			return
+		}
+
 		// Set the user ID in the context for later use in the handler
 		c.Set("userID", userID)
 
@@ -27,41 +47,32 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
-// IsUserManager ensures the user is authenticated AND a manager.
-func ManagerMiddlewar() gin.HandlerFunc {
+// PermissionMiddleware ensures the authenticated user holds the named permission.
+func PermissionMiddleware(permission string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// If the request was aborted in AuthMiddleware, return early
 		if c.IsAborted() {
 			return
 		}
 
-		// Retrieve user ID from context (set by AuthMiddleware)
-		userID, exists := c.Get("userID")
-		if !exists {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "User ID not found in context"})
-			c.Abort()
-			return
-		}
-
-		// Convert userID to the expected type (assuming it's a string)
-		userIDStr, ok := userID.(string)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		// Retrieve user ID from context (set by AuthMiddleware) and make sure the user still exists
+		userID, err := controllers.GetValidUserID(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized: User not found"})
 			c.Abort()
 			return
 		}
 
-		// Fetch user details from the database
-		var currentUser models.User
-		if err := inits.DB.Where("id = ?", userIDStr).First(&currentUser).Error; err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized: User not found"})
+		// Privileged routes stay closed until a required 2FA enrollment is done
+		if controllers.NeedsTwoFactorSetup(userID) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden: two-factor authentication must be enabled first"})
 			c.Abort()
 			return
 		}
 
-		// Check if the user is a manager
-		if !currentUser.Manager {
-			c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden: User is not a manager"})
+		// Check if one of the user's roles grants the permission
+		if !controllers.UserHasPermission(userID, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden: missing permission " + permission})
 			c.Abort()
 			return
 		}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKey is a personal key users create for scripts, bots and CLI tools.
+type APIKey struct {
+	gorm.Model
+	UserID     uint `gorm:"index;not null"`
+	Name       string
+	Prefix     string // First characters of the key so users can tell their keys apart
+	KeyHash    string `gorm:"uniqueIndex" json:"-"`
+	Scopes     string // Comma separated, empty means the key can do anything the user can
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// AuditLog records one privileged action. Rows are only ever inserted, a database
+// trigger rejects updates and deletes, which is why there is no gorm.Model here.
+type AuditLog struct {
+	ID         uint      `gorm:"primarykey"`
+	CreatedAt  time.Time `gorm:"index"`
+	ActorID    *uint     `gorm:"index"` // Nil for actions of the system itself, e.g. the purger
+	ActorName  string    // Kept so the entry stays readable after the actor is purged
+	Action     string    `gorm:"index"` // e.g. "user.deactivate", "role.assign"
+	TargetType string    // e.g. "user", "ip"
+	TargetID   *uint     `gorm:"index"`
+	TargetName string    `gorm:"index"`
+	Before     string    `gorm:"type:text"` // JSON of the changed values before the action
+	After      string    `gorm:"type:text"` // JSON of the changed values after the action
+	IP         string
+	UserAgent  string
+}
@@ -0,0 +1,11 @@
+package models
+
+import "gorm.io/gorm"
+
+// Block stops BlockedID from sending friend requests to UserID, finding them
+// by name or joining sessions they host.
+type Block struct {
+	gorm.Model
+	UserID    uint `gorm:"not null;uniqueIndex:idx_blocks_pair"`
+	BlockedID uint `gorm:"not null;uniqueIndex:idx_blocks_pair;index"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "gorm.io/gorm"
+
+// ContactGroup is a user's own grouping of friends, e.g. "Family". Groups and
+// memberships are deleted for good, so a name can be used again right away.
+type ContactGroup struct {
+	gorm.Model
+	UserID   uint                 `gorm:"not null;uniqueIndex:idx_contact_groups_user_name"`
+	Name     string               `gorm:"size:64;not null;uniqueIndex:idx_contact_groups_user_name"`
+	Position int                  // Order in the friend list, lowest first
+	Members  []ContactGroupMember `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE"`
+}
+
+// ContactGroupMember puts a friend into a group.
+type ContactGroupMember struct {
+	gorm.Model
+	GroupID  uint `gorm:"not null;uniqueIndex:idx_contact_group_members_pair"`
+	FriendID uint `gorm:"not null;uniqueIndex:idx_contact_group_members_pair;index"`
+}
+
+// Favorite stars a friend, it only shows for the user who starred them.
+type Favorite struct {
+	gorm.Model
+	UserID     uint `gorm:"not null;uniqueIndex:idx_favorites_pair"`
+	FavoriteID uint `gorm:"not null;uniqueIndex:idx_favorites_pair;index"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// States of a DataExport.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is a zip archive of everything stored about a user, built in the background.
+type DataExport struct {
+	gorm.Model
+	UserID    uint   `gorm:"index;not null"`
+	Status    string `gorm:"default:'pending'"`
+	FilePath  string `json:"-"` // Outside uploads, which is served publicly
+	Size      int64
+	Error     string
+	ExpiresAt *time.Time // Set once ready, the file is deleted after this
+}
@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// ExternalIdentity links a user to an account at an OpenID Connect provider.
+type ExternalIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null"`
+	Provider string `gorm:"uniqueIndex:idx_external_identity"` // Issuer URL of the provider
+	Subject  string `gorm:"uniqueIndex:idx_external_identity"` // "sub" claim, stable per provider
+	Email    string
+}
@@ -1,10 +1,25 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Friend request states. Declined and cancelled requests are kept for history and
+// do not stop a new request from being sent.
+const (
+	FriendPending   = "pending"
+	FriendAccepted  = "accepted"
+	FriendDeclined  = "declined"
+	FriendCancelled = "cancelled"
+)
 
 type Friend struct {
 	gorm.Model
-	UserID   uint `gorm:"not null"`
-	FriendID uint `gorm:"not null"`
-	Accepted bool `gorm:"default:false"`
+	UserID      uint       `gorm:"not null"`      // Sender of the request
+	FriendID    uint       `gorm:"not null"`      // Recipient of the request
+	Accepted    bool       `gorm:"default:false"` // Kept in sync with Status for older clients
+	Status      string     `gorm:"default:'pending';index"`
+	RespondedAt *time.Time // When the request was accepted, declined or cancelled
 }
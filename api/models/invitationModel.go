@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Invitation states. Pending invitations expire when their session ends.
+const (
+	InvitePending  = "pending"
+	InviteAccepted = "accepted"
+	InviteDeclined = "declined"
+	InviteExpired  = "expired"
+)
+
+// SessionInvitation invites one user to a session. Inviting the same user again
+// reuses the row.
+type SessionInvitation struct {
+	gorm.Model
+	SessionID   uint   `gorm:"not null;uniqueIndex:idx_session_invitations_pair"`
+	InviterID   uint   `gorm:"not null"`
+	InviteeID   uint   `gorm:"not null;uniqueIndex:idx_session_invitations_pair;index"`
+	Status      string `gorm:"not null;default:'pending'"`
+	RespondedAt *time.Time
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginThrottle tracks failed logins for one account name or one IP address.
+type LoginThrottle struct {
+	gorm.Model
+	Key           string `gorm:"uniqueIndex"` // "name:<account name>" or "ip:<address>"
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification types
+const (
+	NotifyFriendRequest   = "friend_request.received"
+	NotifyFriendAccepted  = "friend_request.accepted"
+	NotifyFriendDeclined  = "friend_request.declined"
+	NotifyFriendCancelled = "friend_request.cancelled"
+	NotifyFriendRemoved   = "friend.removed"
+	NotifySessionInvite   = "session.invite"
+	NotifyInviteAccepted  = "session.invite_accepted"
+	NotifyInviteDeclined  = "session.invite_declined"
+)
+
+// Notification is an event for one user, kept until read so it survives being offline
+type Notification struct {
+	gorm.Model
+	UserID      uint   `gorm:"not null;index:idx_notifications_user_read"`
+	Type        string `gorm:"not null"`
+	ActorID     *uint  `gorm:"index"` // User who caused the event, nil for the system
+	ActorName   string
+	SessionID   *uint      `json:",omitempty"` // Session the event is about, if any
+	SessionName string     `json:",omitempty"`
+	InviteID    *uint      `json:",omitempty"` // Invitation to accept or decline, for session.invite
+	ReadAt      *time.Time `gorm:"index:idx_notifications_user_read"`
+	DeliveredAt *time.Time `json:"-"` // Set once pushed to an open websocket
+}
@@ -0,0 +1,31 @@
+package models
+
+import "gorm.io/gorm"
+
+// UserPreferences holds the per-user settings, one row per user once they change anything.
+type UserPreferences struct {
+	gorm.Model
+	UserID                uint `gorm:"uniqueIndex;not null"`
+	JoinWithCameraOff     bool
+	JoinMuted             bool
+	ShowPresenceToFriends bool // No gorm default, it would overwrite an explicit false on create
+	Discoverable          bool // Shown to others in friend suggestions
+}
+
+// DefaultPreferences are the settings of a user who never saved any.
+func DefaultPreferences(userID uint) UserPreferences {
+	return UserPreferences{
+		UserID:                userID,
+		ShowPresenceToFriends: true,
+		Discoverable:          true,
+	}
+}
+
+// PreferencesFor loads a user's preferences, falling back to the defaults.
+func PreferencesFor(db *gorm.DB, userID uint) UserPreferences {
+	var preferences UserPreferences
+	if err := db.Where("user_id = ?", userID).First(&preferences).Error; err != nil {
+		return DefaultPreferences(userID)
+	}
+	return preferences
+}
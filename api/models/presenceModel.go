@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserStatus is a status the user set by hand, e.g. do not disturb until 17:00.
+type UserStatus struct {
+	gorm.Model
+	UserID    uint       `gorm:"uniqueIndex;not null"`
+	Status    string     // online, away or dnd
+	Message   string     `gorm:"size:100"`
+	ExpiresAt *time.Time // Nil means until cleared
+}
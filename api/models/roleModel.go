@@ -0,0 +1,48 @@
+package models
+
+import "gorm.io/gorm"
+
+// Named permissions checked by middleware.PermissionMiddleware.
+const (
+	PermUsersDelete       = "users.delete"
+	PermUsersManage       = "users.manage" // Edit other users' profiles
+	PermUsersUnlock       = "users.unlock" // Clear login lockouts
+	PermRolesAssign       = "roles.assign"
+	PermUsersSecurity     = "users.security" // Security policies such as required 2FA
+	PermSessionsCreate    = "sessions.create"
+	PermSessionsEndAny    = "sessions.end_any"
+	PermRecordingsViewAll = "recordings.view_all"
+	PermAuditView         = "audit.view"
+	PermUsersImport       = "users.import" // Bulk CSV provisioning
+)
+
+// Built-in roles.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleHost      = "host"
+	RoleMember    = "member"
+)
+
+// DefaultRolePermissions is the permission set of every built-in role.
+var DefaultRolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermUsersDelete, PermUsersManage, PermUsersUnlock, PermRolesAssign, PermUsersSecurity,
+		PermSessionsCreate, PermSessionsEndAny, PermRecordingsViewAll, PermAuditView, PermUsersImport,
+	},
+	RoleModerator: {PermUsersManage, PermUsersUnlock, PermSessionsCreate, PermSessionsEndAny, PermRecordingsViewAll},
+	RoleHost:      {PermSessionsCreate},
+	RoleMember:    {},
+}
+
+type Permission struct {
+	gorm.Model
+	Name string `gorm:"unique"`
+}
+
+type Role struct {
+	gorm.Model
+	Name             string       `gorm:"unique"`
+	Permissions      []Permission `gorm:"many2many:role_permissions;"`
+	RequireTwoFactor bool         // Holders must enroll in 2FA before using privileged routes
+}
@@ -7,9 +7,28 @@ type Session struct {
 	Name         string        `gorm:"unique"`
 	HostID       uint          // User who created the session (host).
 	Host         User          `gorm:"foreignKey:HostID"`
-	Status       string        `gorm:"default:'active'"`     // Can be 'active' or 'ended'.
+	Status       string        `gorm:"default:'active'"`     // 'active', 'inactive' once everyone left, or 'ended' by a host.
 	UserSessions []UserSession `gorm:"foreignKey:SessionID"` // Relationship with user sessions.
 	McAddr       string        //Multicast address
+	Private      bool          `gorm:"not null;default:false"` // Only the host and invited users may join
+	PasscodeHash []byte        `json:"-"`                      // Empty when the session has no passcode
+	WaitingRoom  bool          `gorm:"not null;default:false"` // Joining users wait until a host admits them
+	Locked       bool          `gorm:"not null;default:false"` // Nobody but the moderators can join
+}
+
+// SessionCoHost lets a user moderate a session next to its host
+type SessionCoHost struct {
+	gorm.Model
+	SessionID uint `gorm:"not null;uniqueIndex:idx_session_co_hosts_pair"`
+	UserID    uint `gorm:"not null;uniqueIndex:idx_session_co_hosts_pair;index"`
+}
+
+// SessionBan keeps a user who was removed from a session from joining it again
+type SessionBan struct {
+	gorm.Model
+	SessionID uint `gorm:"not null;uniqueIndex:idx_session_bans_pair"`
+	UserID    uint `gorm:"not null;uniqueIndex:idx_session_bans_pair;index"`
+	BannedBy  uint `gorm:"not null"`
 }
 
 type UserSession struct {
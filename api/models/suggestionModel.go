@@ -0,0 +1,10 @@
+package models
+
+import "gorm.io/gorm"
+
+// SuggestionDismissal hides DismissedID from UserID's friend suggestions for good.
+type SuggestionDismissal struct {
+	gorm.Model
+	UserID      uint `gorm:"not null;uniqueIndex:idx_suggestion_dismissals_pair"`
+	DismissedID uint `gorm:"not null;uniqueIndex:idx_suggestion_dismissals_pair"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuthToken is the persisted access/refresh token pair issued on login.
+type AuthToken struct {
+	gorm.Model
+	UserID           uint   `gorm:"index;not null"`
+	AccessID         string `gorm:"uniqueIndex"` // jti of the access JWT
+	RefreshHash      string `gorm:"uniqueIndex"` // SHA-256 of the refresh token, never the token itself
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+	RevokedAt        *time.Time
+	UserAgent        string
+	IP               string
+}
+
+// RevokedToken lists access tokens that must be rejected before they expire.
+type RevokedToken struct {
+	gorm.Model
+	AccessID  string    `gorm:"uniqueIndex"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time // After this the JWT is invalid anyway and the row can be pruned.
+	Reason    string
+}
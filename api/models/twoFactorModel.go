@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode is a one-time code that replaces a TOTP code when the authenticator is lost.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null"`
+	CodeHash string `gorm:"index"`
+	UsedAt   *time.Time
+}
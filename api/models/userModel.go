@@ -1,11 +1,58 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type User struct {
 	gorm.Model
-	Name     string `gorm:"unique"`
-	Password []byte `json:"-"`
-	ImgPath  string
-	Manager  bool
+	Name          string `gorm:"unique"`
+	Password      []byte `json:"-"`
+	Email         string `gorm:"uniqueIndex:idx_users_email,where:email <> ''"` // Stored lower case, empty if not set
+	EmailVerified bool
+	ImgPath       string // Served URL of the 256px avatar, set by the avatar upload
+	AvatarKey     string `json:"-"` // File name prefix of the current avatar under uploads/avatars
+	Manager       bool   // Kept in sync with the admin role for older clients
+	Roles         []Role `gorm:"many2many:user_roles;"`
+
+	// Profile, all optional
+	DisplayName string `gorm:"size:64"`
+	Bio         string `gorm:"size:500"`
+	Timezone    string // IANA name, e.g. "Asia/Jerusalem"
+	Locale      string // BCP 47 tag, e.g. "he-IL"
+	Pronouns    string `gorm:"size:32"`
+
+	// Two-factor authentication
+	TOTPSecret        string `json:"-"` // Set on enrollment, only used once TOTPEnabled
+	TOTPEnabled       bool
+	TOTPLastCounter   int64 `json:"-"` // Last accepted time step, stops codes from being replayed
+	TwoFactorRequired bool
+
+	MustChangePassword bool // Set on imported accounts until the temporary password is replaced
+}
+
+// PublicUser is the part of a profile any signed-in user may see
+type PublicUser struct {
+	ID          uint
+	Name        string
+	DisplayName string
+	ImgPath     string
+	Bio         string
+	Pronouns    string
+	CreatedAt   time.Time
+}
+
+// Public returns the public profile fields of the user
+func (u User) Public() PublicUser {
+	return PublicUser{
+		ID:          u.ID,
+		Name:        u.Name,
+		DisplayName: u.DisplayName,
+		ImgPath:     u.ImgPath,
+		Bio:         u.Bio,
+		Pronouns:    u.Pronouns,
+		CreatedAt:   u.CreatedAt,
+	}
 }
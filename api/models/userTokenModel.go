@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Purposes of a UserToken.
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+// UserToken is a single-use token mailed to a user, e.g. to verify an email or reset a password.
+type UserToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index;not null"`
+	Purpose   string `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	Email     string // The address the token was sent to
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Waiting room states. Admitted users get a UserSession, rejected ones may ask again.
+const (
+	WaitingPending  = "waiting"
+	WaitingAdmitted = "admitted"
+	WaitingRejected = "rejected"
+)
+
+// WaitingRoomEntry holds a user who asked to join a session with a waiting room.
+// Until admitted they have no UserSession, so no media and no participant list.
+type WaitingRoomEntry struct {
+	gorm.Model
+	SessionID uint   `gorm:"not null;uniqueIndex:idx_waiting_room_pair"`
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_waiting_room_pair;index"`
+	Status    string `gorm:"not null;default:'waiting'"`
+	DecidedBy *uint  // Host or co-host who admitted or rejected the user
+	DecidedAt *time.Time
+}
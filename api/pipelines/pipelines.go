@@ -0,0 +1,61 @@
+// Package pipelines tracks the ffmpeg processes that carry each user's media, so a
+// participant or a whole meeting can be torn down from outside the dasher.
+package pipelines
+
+import "sync"
+
+type pipeline struct {
+	sessionID uint
+	userID    uint
+	stop      func()
+}
+
+var (
+	mu     sync.Mutex
+	nextID uint64
+	active = map[uint64]pipeline{}
+)
+
+// Track registers how to stop a running pipeline of a user in a session. The returned
+// function forgets it again and must be called once the pipeline has exited.
+func Track(sessionID, userID uint, stop func()) (untrack func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	id := nextID
+	active[id] = pipeline{sessionID: sessionID, userID: userID, stop: stop}
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(active, id)
+	}
+}
+
+// Removes and returns the pipelines that match, so each is stopped once
+func take(match func(pipeline) bool) []pipeline {
+	mu.Lock()
+	defer mu.Unlock()
+	var taken []pipeline
+	for id, p := range active {
+		if match(p) {
+			taken = append(taken, p)
+			delete(active, id)
+		}
+	}
+	return taken
+}
+
+// StopUser stops every pipeline of one user in a session
+func StopUser(sessionID, userID uint) {
+	for _, p := range take(func(p pipeline) bool { return p.sessionID == sessionID && p.userID == userID }) {
+		p.stop()
+	}
+}
+
+// StopSession stops every pipeline of a session
+func StopSession(sessionID uint) {
+	for _, p := range take(func(p pipeline) bool { return p.sessionID == sessionID }) {
+		p.stop()
+	}
+}
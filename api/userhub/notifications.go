@@ -0,0 +1,98 @@
+package userhub
+
+import (
+	"log"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most notifications sent in one go when a user reconnects, older ones stay in the list endpoint
+const maxReplayedNotifications = 100
+
+// UnreadCount returns how many notifications the user has not read yet
+func UnreadCount(userID uint) int64 {
+	var count int64
+	inits.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// Notify stores a notification for userID about actor and pushes it right away if the
+// user is connected. Otherwise it is sent when they next open the user websocket.
+func Notify(userID uint, notificationType string, actor *models.User) {
+	send(newNotification(userID, notificationType, actor))
+}
+
+// NotifySession is Notify for an event about a session, such as an invitation
+func NotifySession(userID uint, notificationType string, actor *models.User, session models.Session) {
+	notification := newNotification(userID, notificationType, actor)
+	notification.SessionID = &session.ID
+	notification.SessionName = session.Name
+	send(notification)
+}
+
+// NotifyInvitation tells the invitee about a session invitation they can accept or decline
+func NotifyInvitation(invitation models.SessionInvitation, actor *models.User, session models.Session) {
+	notification := newNotification(invitation.InviteeID, models.NotifySessionInvite, actor)
+	notification.SessionID = &session.ID
+	notification.SessionName = session.Name
+	notification.InviteID = &invitation.ID
+	send(notification)
+}
+
+func newNotification(userID uint, notificationType string, actor *models.User) models.Notification {
+	notification := models.Notification{UserID: userID, Type: notificationType}
+	if actor != nil {
+		notification.ActorID = &actor.ID
+		notification.ActorName = actor.Name
+	}
+	return notification
+}
+
+func send(notification models.Notification) {
+	if err := inits.DB.Create(&notification).Error; err != nil {
+		log.Printf("Failed to store %s notification for user %d: %v", notification.Type, notification.UserID, err)
+		return
+	}
+
+	if SendToUser(notification.UserID, gin.H{"type": "notification", "notification": notification, "unread": UnreadCount(notification.UserID)}) {
+		markDelivered([]uint{notification.ID})
+	}
+}
+
+// PushUnreadCount tells every open connection of the user the current unread count,
+// e.g. after notifications were read in another tab
+func PushUnreadCount(userID uint) {
+	SendToUser(userID, gin.H{"type": "notifications_read", "unread": UnreadCount(userID)})
+}
+
+func markDelivered(ids []uint) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := inits.DB.Model(&models.Notification{}).Where("id IN ?", ids).Update("delivered_at", time.Now()).Error; err != nil {
+		log.Printf("Failed to mark notifications delivered: %v", err)
+	}
+}
+
+// Sends what the user missed while offline. Clients drop notifications whose ID they
+// already have, a notification created during the reconnect may arrive twice.
+func replayNotifications(userID uint) {
+	var missed []models.Notification
+	if err := inits.DB.Where("user_id = ? AND delivered_at IS NULL AND read_at IS NULL", userID).
+		Order("id").Limit(maxReplayedNotifications).Find(&missed).Error; err != nil {
+		log.Printf("Failed to load missed notifications of user %d: %v", userID, err)
+		return
+	}
+
+	if !SendToUser(userID, gin.H{"type": "notifications_snapshot", "unread": UnreadCount(userID), "missed": missed}) {
+		return
+	}
+	ids := make([]uint, 0, len(missed))
+	for _, notification := range missed {
+		ids = append(ids, notification.ID)
+	}
+	markDelivered(ids)
+}
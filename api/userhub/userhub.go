@@ -0,0 +1,431 @@
+// Package userhub keeps a websocket per signed-in user, independent of sessions,
+// tracks their presence for friends and delivers their notifications.
+package userhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"yuval/inits"
+	"yuval/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+)
+
+// Presence states
+const (
+	StatusOnline    = "online"
+	StatusAway      = "away"
+	StatusDND       = "dnd"
+	StatusInMeeting = "in_meeting"
+	StatusOffline   = "offline"
+)
+
+const (
+	pingInterval = 30 * time.Second
+	writeTimeout = 10 * time.Second
+	sendBuffer   = 32
+)
+
+// Presence is what other users see of a user
+type Presence struct {
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // When a manual status ends
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`  // Only while offline
+}
+
+type client struct {
+	userID     uint
+	conn       *websocket.Conn
+	send       chan []byte
+	lastActive time.Time
+	idle       bool // The client reported no user activity
+}
+
+type hub struct {
+	mu         sync.Mutex
+	clients    map[uint]map[*client]bool
+	meetings   map[uint]int // Session websockets per user, see SetInMeeting
+	manual     map[uint]models.UserStatus
+	lastSeen   map[uint]time.Time
+	lastPushed map[uint]string
+}
+
+var h = &hub{
+	clients:    make(map[uint]map[*client]bool),
+	meetings:   make(map[uint]int),
+	manual:     make(map[uint]models.UserStatus),
+	lastSeen:   make(map[uint]time.Time),
+	lastPushed: make(map[uint]string),
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow all origins
+	},
+}
+
+func awayAfter() time.Duration {
+	return time.Duration(viper.GetInt("presence.awayMinutes")) * time.Minute
+}
+
+func heartbeatTimeout() time.Duration {
+	return time.Duration(viper.GetInt("presence.heartbeatTimeoutSeconds")) * time.Second
+}
+
+// Works out a user's presence, the caller holds h.mu
+func (h *hub) presenceLocked(userID uint, now time.Time) Presence {
+	clients := h.clients[userID]
+	inMeeting := h.meetings[userID] > 0
+
+	if len(clients) == 0 && !inMeeting {
+		presence := Presence{Status: StatusOffline}
+		if lastSeen, ok := h.lastSeen[userID]; ok {
+			presence.LastSeen = &lastSeen
+		}
+		return presence
+	}
+
+	var message string
+	if manual, ok := h.manual[userID]; ok && (manual.ExpiresAt == nil || manual.ExpiresAt.After(now)) {
+		message = manual.Message
+		// Do not disturb wins over everything, away only while not in a meeting
+		if manual.Status == StatusDND || (manual.Status == StatusAway && !inMeeting) {
+			return Presence{Status: manual.Status, Message: message, ExpiresAt: manual.ExpiresAt}
+		}
+	}
+
+	if inMeeting {
+		return Presence{Status: StatusInMeeting, Message: message}
+	}
+
+	for c := range clients {
+		if !c.idle && now.Sub(c.lastActive) < awayAfter() {
+			return Presence{Status: StatusOnline, Message: message}
+		}
+	}
+	return Presence{Status: StatusAway, Message: message}
+}
+
+// PresenceOf returns a user's presence as the user themself sees it
+func PresenceOf(userID uint) Presence {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.presenceLocked(userID, time.Now())
+}
+
+// FriendPresence returns a user's presence as their friends see it
+func FriendPresence(userID uint) Presence {
+	return VisiblePresence(userID, models.PreferencesFor(inits.DB, userID).ShowPresenceToFriends)
+}
+
+// VisiblePresence is FriendPresence for a caller that already loaded the user's
+// ShowPresenceToFriends preference
+func VisiblePresence(userID uint, shown bool) Presence {
+	if !shown {
+		return Presence{Status: StatusOffline}
+	}
+	return PresenceOf(userID)
+}
+
+// IDs of the user's accepted friends
+func friendIDs(userID uint) []uint {
+	var connections []models.Friend
+	if err := inits.DB.Where("(user_id = ? OR friend_id = ?) AND accepted = ?", userID, userID, true).Find(&connections).Error; err != nil {
+		log.Printf("Failed to load friends of user %d: %v", userID, err)
+		return nil
+	}
+
+	ids := make([]uint, 0, len(connections))
+	for _, conn := range connections {
+		if conn.UserID == userID {
+			ids = append(ids, conn.FriendID)
+		} else {
+			ids = append(ids, conn.UserID)
+		}
+	}
+	return ids
+}
+
+// SendToUser pushes a JSON message to every user-level websocket of a user and
+// reports whether at least one connection took it
+func SendToUser(userID uint, v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode message: %v", err)
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queued := false
+	for c := range h.clients[userID] {
+		select {
+		case c.send <- data:
+			queued = true
+		default:
+			// The client does not keep up, drop it and let it reconnect
+			c.conn.Close()
+		}
+	}
+	return queued
+}
+
+// IsConnected reports whether the user has a user-level websocket open
+func IsConnected(userID uint) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients[userID]) > 0
+}
+
+// Refresh recomputes a user's presence and pushes it to their friends if it changed
+func Refresh(userID uint) {
+	presence := FriendPresence(userID)
+	key := presence.Status + "|" + presence.Message
+
+	h.mu.Lock()
+	if h.lastPushed[userID] == key {
+		h.mu.Unlock()
+		return
+	}
+	h.lastPushed[userID] = key
+	h.mu.Unlock()
+
+	message := gin.H{"type": "presence", "userId": userID, "presence": presence}
+	for _, friendID := range friendIDs(userID) {
+		SendToUser(friendID, message)
+	}
+}
+
+// SetInMeeting records a user joining or leaving a session websocket
+func SetInMeeting(userID uint, joined bool) {
+	h.mu.Lock()
+	if joined {
+		h.meetings[userID]++
+	} else if h.meetings[userID] > 0 {
+		h.meetings[userID]--
+		if h.meetings[userID] == 0 {
+			delete(h.meetings, userID)
+			if len(h.clients[userID]) == 0 {
+				h.lastSeen[userID] = time.Now()
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	Refresh(userID)
+}
+
+// SetManualStatus stores a status set by the user and pushes the change
+func SetManualStatus(userID uint, status, message string, expiresAt *time.Time) error {
+	userStatus := models.UserStatus{UserID: userID}
+	inits.DB.Where("user_id = ?", userID).First(&userStatus)
+	userStatus.Status = status
+	userStatus.Message = message
+	userStatus.ExpiresAt = expiresAt
+	if err := inits.DB.Save(&userStatus).Error; err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.manual[userID] = userStatus
+	h.mu.Unlock()
+
+	Refresh(userID)
+	return nil
+}
+
+// ClearManualStatus removes a status set by the user
+func ClearManualStatus(userID uint) error {
+	if err := inits.DB.Unscoped().Where("user_id = ?", userID).Delete(&models.UserStatus{}).Error; err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	delete(h.manual, userID)
+	h.mu.Unlock()
+
+	Refresh(userID)
+	return nil
+}
+
+// Loads a user's manual status into the cache when they come online
+func loadManualStatus(userID uint) {
+	var userStatus models.UserStatus
+	if err := inits.DB.Where("user_id = ?", userID).First(&userStatus).Error; err != nil {
+		return
+	}
+	h.mu.Lock()
+	h.manual[userID] = userStatus
+	h.mu.Unlock()
+}
+
+// Run periodically recomputes presence, so idle users turn away and manual statuses expire
+func Run() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		var userIDs []uint
+
+		h.mu.Lock()
+		for userID, manual := range h.manual {
+			if manual.ExpiresAt != nil && !manual.ExpiresAt.After(now) {
+				delete(h.manual, userID)
+			}
+		}
+		for userID := range h.clients {
+			userIDs = append(userIDs, userID)
+		}
+		for userID := range h.meetings {
+			if len(h.clients[userID]) == 0 {
+				userIDs = append(userIDs, userID)
+			}
+		}
+		h.mu.Unlock()
+
+		for _, userID := range userIDs {
+			Refresh(userID)
+		}
+	}
+}
+
+// Writes queued messages and keeps the connection alive with pings
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, nil)
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleConnections upgrades GET /ws/user and serves the user's presence connection
+//
+// Clients send {"type":"heartbeat","idle":false} every 30 seconds, with idle set when
+// the user has not touched the app for a while. A connection without heartbeats is
+// closed after presence.heartbeatTimeoutSeconds. The server starts with a
+// presence_snapshot and a notifications_snapshot of what was missed while offline.
+func HandleConnections(c *gin.Context) {
+	userIDInterface, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+		return
+	}
+	userIDUint, err := strconv.ParseUint(fmt.Sprintf("%v", userIDInterface), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid user ID format"})
+		return
+	}
+	userID := uint(userIDUint)
+
+	var user models.User
+	if err := inits.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not found"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+
+	loadManualStatus(userID)
+
+	cl := &client{
+		userID:     userID,
+		conn:       conn,
+		send:       make(chan []byte, sendBuffer),
+		lastActive: time.Now(),
+	}
+	h.mu.Lock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = make(map[*client]bool)
+	}
+	h.clients[userID][cl] = true
+	h.mu.Unlock()
+
+	go cl.writePump()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.clients[userID], cl)
+		if len(h.clients[userID]) == 0 {
+			delete(h.clients, userID)
+			if h.meetings[userID] == 0 {
+				h.lastSeen[userID] = time.Now()
+			}
+		}
+		close(cl.send)
+		h.mu.Unlock()
+
+		Refresh(userID)
+	}()
+
+	// Start with where every friend is, later changes arrive as "presence" messages
+	friends := []gin.H{}
+	for _, friendID := range friendIDs(userID) {
+		friends = append(friends, gin.H{"userId": friendID, "presence": FriendPresence(friendID)})
+	}
+	SendToUser(userID, gin.H{"type": "presence_snapshot", "self": PresenceOf(userID), "friends": friends})
+	Refresh(userID)
+	replayNotifications(userID)
+
+	conn.SetReadDeadline(time.Now().Add(heartbeatTimeout()))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(heartbeatTimeout()))
+		return nil
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break // triggers defer
+		}
+		conn.SetReadDeadline(time.Now().Add(heartbeatTimeout()))
+
+		var message struct {
+			Type string `json:"type"`
+			Idle bool   `json:"idle"`
+		}
+		if err := json.Unmarshal(data, &message); err != nil || message.Type != "heartbeat" {
+			continue
+		}
+
+		h.mu.Lock()
+		cl.idle = message.Idle
+		if !message.Idle {
+			cl.lastActive = time.Now()
+		}
+		h.mu.Unlock()
+
+		Refresh(userID)
+	}
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2id parameters for new hashes (RFC 9106, second recommended option)
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+const argonPrefix = "$argon2id$"
+
+// HashPassword hashes a password with Argon2id in the PHC string format
+func HashPassword(password string) ([]byte, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argonPrefix, argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+type argonParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgonHash(hash []byte) (*argonParams, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2 version")
+	}
+
+	var p argonParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, errors.New("invalid argon2 parameters")
+	}
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2 salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, errors.New("invalid argon2 key")
+	}
+	return &p, nil
+}
+
+// CheckPassword compares a password with an Argon2id hash or a legacy bcrypt hash
+func CheckPassword(hash []byte, password string) error {
+	if !bytes.HasPrefix(hash, []byte(argonPrefix)) {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password))
+	}
+
+	p, err := parseArgonHash(hash)
+	if err != nil {
+		return err
+	}
+
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return errors.New("password does not match")
+	}
+	return nil
+}
+
+// PasswordNeedsRehash reports whether a hash should be replaced with one using the current parameters
+func PasswordNeedsRehash(hash []byte) bool {
+	p, err := parseArgonHash(hash)
+	if err != nil {
+		return true
+	}
+	return p.memory != argonMemory || p.time != argonTime || p.threads != argonThreads || len(p.key) != argonKeyLen
+}
+
+var (
+	denylistOnce sync.Once
+	denylist     map[string]struct{}
+)
+
+// Loads the breached password list, one password per line
+func loadDenylist() {
+	denylist = make(map[string]struct{})
+
+	path := viper.GetString("password.denylistFile")
+	if path == "" {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open password denylist %s: %v", path, err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			denylist[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read password denylist %s: %v", path, err)
+	}
+	log.Printf("Loaded %d breached passwords", len(denylist))
+}
+
+// ValidatePassword checks a new password against the configured password policy
+func ValidatePassword(password, userName string) error {
+	minLength := viper.GetInt("password.minLength")
+	if len([]rune(password)) < minLength {
+		return fmt.Errorf("password must be at least %d characters long", minLength)
+	}
+
+	if userName != "" && strings.EqualFold(password, userName) {
+		return errors.New("password must not be the same as the user name")
+	}
+
+	denylistOnce.Do(loadDenylist)
+	if _, found := denylist[strings.ToLower(password)]; found {
+		return errors.New("password appears in a list of breached passwords, choose another one")
+	}
+	return nil
+}
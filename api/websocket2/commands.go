@@ -0,0 +1,86 @@
+package websocket2
+
+import (
+	"encoding/json"
+	"log"
+	"yuval/inits"
+	"yuval/models"
+	"yuval/userhub"
+
+	"github.com/gorilla/websocket"
+)
+
+// CommandHandler runs a command a client sent over its session websocket. The returned
+// error is sent back to that client only.
+type CommandHandler func(userID, sessionID uint, payload json.RawMessage) error
+
+var commands = map[string]CommandHandler{}
+
+// RegisterCommand makes a JSON message {"type": name, ...} run handler. Handlers live in
+// the packages that own the logic, this one cannot import them. Register before serving.
+func RegisterCommand(name string, handler CommandHandler) {
+	commands[name] = handler
+}
+
+// Runs a message as a command, returns false if it is not one
+func handleCommand(conn *websocket.Conn, userID, sessionID uint, msg []byte) bool {
+	var command struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(msg, &command); err != nil {
+		return false
+	}
+	handler, ok := commands[command.Type]
+	if !ok {
+		return false
+	}
+
+	if err := handler(userID, sessionID, msg); err != nil {
+		writeJSON(conn, map[string]string{"type": "error", "command": command.Type, "message": err.Error()})
+	}
+	return true
+}
+
+// Writes to one connection, under the hub lock like every other write
+func writeJSON(conn *websocket.Conn, v interface{}) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if err := conn.WriteJSON(v); err != nil {
+		log.Println("WebSocket write error:", err)
+	}
+}
+
+// SendToSessionUsers sends a JSON message to the connections of the given users in a session
+func SendToSessionUsers(sessionID uint, userIDs []uint, v interface{}) {
+	wanted := map[uint]bool{}
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, client := range hub.sessionClient[sessionID] {
+		if !wanted[hub.users[client]] {
+			continue
+		}
+		if err := client.WriteJSON(v); err != nil {
+			log.Println("WebSocket write error:", err)
+			client.Close()
+		}
+	}
+}
+
+// Tells users still waiting to join an ended session that nobody will admit them
+func closeWaitingRoom(sessionID uint) {
+	var waiting []uint
+	inits.DB.Model(&models.WaitingRoomEntry{}).
+		Where("session_id = ? AND status = ?", sessionID, models.WaitingPending).
+		Pluck("user_id", &waiting)
+	for _, userID := range waiting {
+		userhub.SendToUser(userID, map[string]interface{}{"type": "waiting_room_closed", "sessionId": sessionID})
+	}
+
+	if err := inits.DB.Unscoped().Where("session_id = ?", sessionID).Delete(&models.WaitingRoomEntry{}).Error; err != nil {
+		log.Printf("Failed to clear the waiting room of session %d: %v", sessionID, err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 	"yuval/inits"
 	"yuval/models"
+	"yuval/pipelines"
+	"yuval/userhub"
 	"yuval/utils"
 
 	"github.com/gin-gonic/gin"
@@ -28,6 +30,7 @@ type Hub struct {
 	unregister    chan *websocket.Conn
 	mu            sync.Mutex
 	sessionClient map[uint][]*websocket.Conn // Use uint for session ID
+	users         map[*websocket.Conn]uint   // User behind each session connection
 }
 
 var hub = Hub{
@@ -36,6 +39,16 @@ var hub = Hub{
 	register:      make(chan *websocket.Conn),
 	unregister:    make(chan *websocket.Conn),
 	sessionClient: make(map[uint][]*websocket.Conn),
+	users:         make(map[*websocket.Conn]uint),
+}
+
+// InitialState is sent to a client right after it connects
+type InitialState struct {
+	Type         string            `json:"type"`
+	SessionID    uint              `json:"sessionId"`
+	User         models.PublicUser `json:"user"`
+	CameraOn     bool              `json:"cameraOn"`
+	MicrophoneOn bool              `json:"microphoneOn"`
 }
 
 func HandleConnections(c *gin.Context) {
@@ -78,13 +91,33 @@ func HandleConnections(c *gin.Context) {
 
 	hub.register <- conn
 
+	// The first message tells the client how to join, from the user's preferences
+	preferences := models.PreferencesFor(inits.DB, user.ID)
+	state := InitialState{
+		Type:         "initial_state",
+		SessionID:    sessionID,
+		User:         user.Public(),
+		CameraOn:     !preferences.JoinWithCameraOff,
+		MicrophoneOn: !preferences.JoinMuted,
+	}
+
 	hub.mu.Lock()
+	// Written under the lock so it cannot interleave with a broadcast
+	if err := conn.WriteJSON(state); err != nil {
+		log.Println("WebSocket write error:", err)
+	}
 	hub.sessionClient[sessionID] = append(hub.sessionClient[sessionID], conn)
+	hub.users[conn] = user.ID
 	hub.mu.Unlock()
 
+	// Friends see the user as in a meeting while the session websocket is open
+	userhub.SetInMeeting(user.ID, true)
+
 	defer func() {
 		log.Printf("Cleaning up WebSocket for user %d in session %d\n", userIDUint, sessionID)
 
+		userhub.SetInMeeting(user.ID, false)
+
 		BroadcastMessage(sessionID, fmt.Sprintf("User %d has left the session %d", userIDUint, sessionID))
 
 		hub.unregister <- conn
@@ -98,6 +131,7 @@ func HandleConnections(c *gin.Context) {
 				break
 			}
 		}
+		delete(hub.users, conn)
 		hub.mu.Unlock()
 
 		// Mark user as having left the session
@@ -119,17 +153,9 @@ func HandleConnections(c *gin.Context) {
 			log.Println("Failed to count users in session:", err)
 		} else if count == 0 {
 			// No users remaining in the session, mark it as inactive
-			var session models.Session
-			if err := inits.DB.First(&session, sessionID).Error; err == nil {
-				session.Status = "inactive"
-				if err := inits.DB.Save(&session).Error; err != nil {
-					log.Println("Failed to mark session as inactive:", err)
-				} else {
-					log.Printf("Session %d marked as inactive\n", sessionID)
-					go HandleSessionEnd(sessionID)
-				}
-			} else {
-				log.Println("Failed to find session for marking inactive:", err)
+			if MarkSessionEnded(sessionID, "inactive") {
+				log.Printf("Session %d marked as inactive\n", sessionID)
+				go HandleSessionEnd(sessionID)
 			}
 		}
 
@@ -143,7 +169,9 @@ func HandleConnections(c *gin.Context) {
 			log.Println("WebSocket read error:", err)
 			break // triggers defer
 		}
-		log.Printf("Received message: %s", msg)
+		if !handleCommand(conn, user.ID, sessionID, msg) {
+			log.Printf("Received message: %s", msg)
+		}
 	}
 }
 
@@ -191,8 +219,61 @@ func BroadcastMessage(sessionID uint, message string) {
 	fmt.Println("Broadcasted to session:", sessionID, "message:", message)
 }
 
+// MarkSessionEnded moves a session to the given end status. Only the caller that gets true
+// may run HandleSessionEnd, so it runs once each time the session empties or is ended,
+// however that happens. Joining an inactive session makes it active again, while an
+// ended one stays ended, so a session everyone left can still be ended for good.
+func MarkSessionEnded(sessionID uint, status string) bool {
+	from := []string{"active"}
+	if status == "ended" {
+		from = append(from, "inactive")
+	}
+	result := inits.DB.Model(&models.Session{}).Where("id = ? AND status IN ?", sessionID, from).Update("status", status)
+	if result.Error != nil {
+		log.Println("Failed to mark session as ended:", result.Error)
+		return false
+	}
+	return result.RowsAffected == 1
+}
+
+// DisconnectUser sends a last message to a user's connections in a session and closes them
+func DisconnectUser(sessionID, userID uint, v interface{}) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, client := range hub.sessionClient[sessionID] {
+		if hub.users[client] != userID {
+			continue
+		}
+		client.WriteJSON(v)
+		client.Close() // The read loop fails and cleans up
+	}
+}
+
+// CloseSession sends a last message to every connection of a session and closes them
+func CloseSession(sessionID uint, v interface{}) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, client := range hub.sessionClient[sessionID] {
+		client.WriteJSON(v)
+		client.Close()
+	}
+}
+
 func HandleSessionEnd(sessionID uint) {
 	// Perform cleanup, analytics, logging, etc.
-	log.Printf("Performing one-time cleanup for ended session %d\n", sessionID)
+	log.Printf("Performing cleanup for ended session %d\n", sessionID)
+	// The recordings are converted once nothing writes to them anymore
+	pipelines.StopSession(sessionID)
+	// A session everyone left can be joined again, so the waiting room and
+	// invitations nobody answered only close once it is ended
+	var session models.Session
+	if err := inits.DB.Select("id", "status").First(&session, sessionID).Error; err == nil && session.Status == "ended" {
+		closeWaitingRoom(sessionID)
+		if err := inits.DB.Model(&models.SessionInvitation{}).
+			Where("session_id = ? AND status = ?", sessionID, models.InvitePending).
+			Update("status", models.InviteExpired).Error; err != nil {
+			log.Printf("Failed to expire invitations of session %d: %v", sessionID, err)
+		}
+	}
 	utils.ConvertSessionDashToMP4(sessionID)
 }
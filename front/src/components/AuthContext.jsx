@@ -1,7 +1,23 @@
 import React, { createContext, useState, useEffect } from 'react';
 
+// Without input for this long the user is reported idle and shows as away
+const IDLE_AFTER_MS = 5 * 60 * 1000;
+
 export const AuthContext = createContext();
 
+const refreshSession = async () => {
+  try {
+    const response = await fetch('https://localhost:3000/users/refresh', {
+      method: 'POST',
+      credentials: 'include',
+    });
+    return response.ok;
+  } catch (error) {
+    console.error('Error refreshing session:', error);
+    return false;
+  }
+};
+
 export const AuthProvider = ({ children }) => {
   const [isLoggedIn, setIsLoggedIn] = useState(false);
   const [loading, setLoading] = useState(true);
@@ -10,11 +26,19 @@ export const AuthProvider = ({ children }) => {
   useEffect(() => {
     const checkAuth = async () => {
       try {
-        const response = await fetch('https://localhost:3000/users/cookie', {
+        let response = await fetch('https://localhost:3000/users/cookie', {
           method: 'GET',
           credentials: 'include',
         });
 
+        // The access token may have expired, try to rotate it with the refresh token
+        if (response.status === 401 && (await refreshSession())) {
+          response = await fetch('https://localhost:3000/users/cookie', {
+            method: 'GET',
+            credentials: 'include',
+          });
+        }
+
         if (!response.ok) throw new Error('Unauthorized');
 
         setIsLoggedIn(true);
@@ -29,11 +53,85 @@ export const AuthProvider = ({ children }) => {
     checkAuth();
   }, []);
 
+  // Keep the short-lived access token fresh while the user is logged in
+  useEffect(() => {
+    if (!isLoggedIn) return;
+    const interval = setInterval(refreshSession, 10 * 60 * 1000);
+    return () => clearInterval(interval);
+  }, [isLoggedIn]);
+
+  // User-level websocket: sends heartbeats, receives friends' presence and notifications
+  const [friendPresence, setFriendPresence] = useState({});
+  const [notifications, setNotifications] = useState([]);
+  const [unreadCount, setUnreadCount] = useState(0);
+  // Latest answer to waiting in a waiting room: admitted, rejected or closed
+  const [waitingRoomEvent, setWaitingRoomEvent] = useState(null);
+  useEffect(() => {
+    if (!isLoggedIn) return;
+
+    let lastInput = Date.now();
+    const onInput = () => { lastInput = Date.now(); };
+    window.addEventListener('mousemove', onInput);
+    window.addEventListener('keydown', onInput);
+
+    const ws = new WebSocket('wss://localhost:3000/ws/user');
+    const sendHeartbeat = () => {
+      if (ws.readyState !== WebSocket.OPEN) return;
+      const idle = document.hidden || Date.now() - lastInput > IDLE_AFTER_MS;
+      ws.send(JSON.stringify({ type: 'heartbeat', idle }));
+    };
+    ws.onopen = sendHeartbeat;
+    ws.onmessage = (event) => {
+      const data = JSON.parse(event.data);
+      if (data.type === 'presence_snapshot') {
+        const snapshot = {};
+        data.friends.forEach((f) => { snapshot[f.userId] = f.presence; });
+        setFriendPresence(snapshot);
+      } else if (data.type === 'presence') {
+        setFriendPresence((prev) => ({ ...prev, [data.userId]: data.presence }));
+      } else if (data.type === 'notifications_snapshot' || data.type === 'notification') {
+        // A notification can arrive twice around a reconnect, keep one per ID
+        const incoming = data.type === 'notification' ? [data.notification] : data.missed;
+        setNotifications((prev) => {
+          const known = new Set(prev.map((n) => n.ID));
+          return [...incoming.filter((n) => !known.has(n.ID)).reverse(), ...prev];
+        });
+        setUnreadCount(data.unread);
+      } else if (data.type === 'notifications_read') {
+        setUnreadCount(data.unread);
+      } else if (data.type.startsWith('waiting_room_')) {
+        setWaitingRoomEvent(data);
+      }
+    };
+    const interval = setInterval(sendHeartbeat, 30 * 1000);
+
+    return () => {
+      clearInterval(interval);
+      window.removeEventListener('mousemove', onInput);
+      window.removeEventListener('keydown', onInput);
+      ws.close();
+    };
+  }, [isLoggedIn]);
+
+  const markNotificationsRead = async () => {
+    try {
+      const res = await fetch('https://localhost:3000/notifications/read', {
+        method: 'POST',
+        credentials: 'include',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ all: true }),
+      });
+      if (res.ok) setUnreadCount((await res.json()).unread);
+    } catch (error) {
+      console.error('Error marking notifications read:', error);
+    }
+  };
+
   const login = () => setIsLoggedIn(true);
   const logout = () => setIsLoggedIn(false);
 
   return (
-    <AuthContext.Provider value={{ isLoggedIn, login, logout, loading, userUpdated, setUserUpdated }}>
+    <AuthContext.Provider value={{ isLoggedIn, login, logout, loading, userUpdated, setUserUpdated, friendPresence, notifications, unreadCount, markNotificationsRead, waitingRoomEvent }}>
       {children}
     </AuthContext.Provider>
   );
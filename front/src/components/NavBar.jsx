@@ -1,7 +1,9 @@
-import React, { useEffect, useState, useContext } from 'react';
+import React, { useEffect, useRef, useState, useContext } from 'react';
 import { Link, useNavigate } from 'react-router-dom';
+import Swal from 'sweetalert2';
 import './NavBar.css';
 import logo from '../assets/logo.webp';
+import defaultProfile from '../assets/deafultProfile.avif';
 import { AuthContext } from './AuthContext';
 
 const Navbar = () => {
@@ -9,8 +11,9 @@ const Navbar = () => {
   const [error, setError] = useState(null);
   const [darkMode, setDarkMode] = useState(() => localStorage.getItem('theme') === 'dark');
   const [isMenuOpen, setIsMenuOpen] = useState(false);
-  const { isLoggedIn, logout, loading, userUpdated } = useContext(AuthContext);
+  const { isLoggedIn, logout, loading, userUpdated, notifications, unreadCount, markNotificationsRead } = useContext(AuthContext);
   const navigate = useNavigate();
+  const promptedInvites = useRef(new Set());
 
   useEffect(() => {
     document.body.className = darkMode ? 'dark-mode' : 'light-mode';
@@ -49,6 +52,36 @@ const Navbar = () => {
     }
   }, [isLoggedIn, loading, userUpdated]);
 
+  // Ask about each new session invite once, answering it here accepts or declines it
+  useEffect(() => {
+    const invite = notifications.find((n) =>
+      n.Type === 'session.invite' && !n.ReadAt && !promptedInvites.current.has(n.InviteID));
+    if (!invite) return;
+    promptedInvites.current.add(invite.InviteID);
+
+    Swal.fire({
+      title: 'Meeting invite',
+      text: `${invite.ActorName} invited you to ${invite.SessionName}`,
+      showCancelButton: true,
+      confirmButtonText: 'Join',
+      cancelButtonText: 'Decline',
+    }).then(async (result) => {
+      if (result.dismiss && result.dismiss !== Swal.DismissReason.cancel) return; // Closed, decide later
+      const action = result.isConfirmed ? 'accept' : 'decline';
+      try {
+        const response = await fetch(`https://localhost:3000/sessions/invitations/${invite.InviteID}/${action}`, {
+          method: 'POST',
+          credentials: 'include',
+        });
+        const data = await response.json();
+        if (!response.ok) throw new Error(data.message);
+        if (result.isConfirmed) navigate(`/m/${data.session}`);
+      } catch (error) {
+        Swal.fire({ icon: 'error', title: 'Invite', text: error.message });
+      }
+    });
+  }, [notifications, navigate]);
+
   const handleLogout = async (e) => {
     e.preventDefault();
 
@@ -96,7 +129,7 @@ const Navbar = () => {
               {user && (
                   <div className="user-show">
                   <li className="user-profile">
-                    <img src={user.ImgPath} alt="Profile" />
+                    <img src={user.ImgPath || defaultProfile} alt="Profile" />
                     <Link to="/edit">
                       <span id="user">
                         {user.Name || 'User'} {user.Manager && "🧑🏻‍💻"}
@@ -105,6 +138,11 @@ const Navbar = () => {
                   </li>
                   </div>
               )}
+              <li>
+                <Link to="/friends" className="notifications" onClick={markNotificationsRead}>
+                  🔔{unreadCount > 0 && <span className="badge">{unreadCount}</span>}
+                </Link>
+              </li>
               <li>
                 <button className="Logout" onClick={handleLogout}>
                   <div className="sign">
@@ -11,6 +11,11 @@ const CreateMeeting = () => {
   const navigate = useNavigate();
   const { isLoggedIn, logout, loading } = useContext(AuthContext);
   const [user, setUser] = useState(null);
+  const [groups, setGroups] = useState([]);
+  const [groupId, setGroupId] = useState('');
+  const [isPrivate, setIsPrivate] = useState(false);
+  const [passcode, setPasscode] = useState('');
+  const [waitingRoom, setWaitingRoom] = useState(false);
 
   // Function to generate a random Room ID
   const generateRoomID = (length = 10) => {
@@ -57,6 +62,10 @@ const CreateMeeting = () => {
       navigate('/login'); 
     } else {
       fetchUser();
+      fetch('https://localhost:3000/friends/groups', { credentials: 'include' })
+        .then((res) => (res.ok ? res.json() : { groups: [] }))
+        .then((data) => setGroups(data.groups))
+        .catch((err) => console.error('Error fetching groups:', err));
     }
   }, [isLoggedIn, loading, navigate, logout]);
 
@@ -86,7 +95,7 @@ const CreateMeeting = () => {
           'Content-Type': 'application/json',
         },
         credentials: 'include', // Ensures cookies are sent with the request
-        body: JSON.stringify({ name: sessionId }),
+        body: JSON.stringify({ name: sessionId, groupId: groupId ? Number(groupId) : undefined, private: isPrivate, passcode, waitingRoom }),
       });
 
       if (!response.ok) {
@@ -97,7 +106,9 @@ const CreateMeeting = () => {
       Swal.fire({
         icon: 'success',
         title: 'Meeting Created!',
-        text: 'Session created successfully!',
+        text: data.invited.length
+          ? `Session created, invited ${data.invited.join(', ')}.`
+          : 'Session created successfully!',
       });
 
       // Redirect to the meeting room
@@ -166,6 +177,37 @@ const CreateMeeting = () => {
           Generate New ID
         </button>
 
+        {groups.length > 0 && (
+          <div className="form-group">
+            <label htmlFor="group">Invite group:</label>
+            <select id="group" value={groupId} onChange={(e) => setGroupId(e.target.value)}>
+              <option value="">Nobody</option>
+              {groups.map((group) => (
+                <option key={group.id} value={group.id}>{group.name}</option>
+              ))}
+            </select>
+          </div>
+        )}
+
+        <div className="form-group">
+          <label htmlFor="private">
+            <input type="checkbox" id="private" checked={isPrivate} onChange={(e) => setIsPrivate(e.target.checked)} />
+            {' '}Invited users only
+          </label>
+        </div>
+
+        <div className="form-group">
+          <label htmlFor="waitingRoom">
+            <input type="checkbox" id="waitingRoom" checked={waitingRoom} onChange={(e) => setWaitingRoom(e.target.checked)} />
+            {' '}Waiting room
+          </label>
+        </div>
+
+        <div className="form-group">
+          <label htmlFor="passcode">Passcode (optional):</label>
+          <input type="text" id="passcode" value={passcode} maxLength={64} onChange={(e) => setPasscode(e.target.value)} />
+        </div>
+
         {error && <p className="error">{error}</p>}
 
         <button type="submit" className="btn">Create Room</button>
@@ -112,7 +112,6 @@ const EditUser = () => {
         credentials: "include",
         body: JSON.stringify({
           Name: updatedUser.Name,
-          ImgPath: updatedUser.ImgPath,
           Manager: updatedUser.Manager,
           userName: name || undefined, // Send userName if updating another user's details
         }),
@@ -138,15 +137,29 @@ const EditUser = () => {
   };
   
 
-  const handleImageUpload = (e) => {
+  const handleImageUpload = async (e) => {
     const file = e.target.files[0];
     if (!file) return;
 
-    const reader = new FileReader();
-    reader.onloadend = () => {
-      setUpdatedUser((prev) => ({ ...prev, ImgPath: reader.result }));
-    };
-    reader.readAsDataURL(file);
+    // Avatars are validated and resized by the server, only the own avatar can be changed
+    const formData = new FormData();
+    formData.append("avatar", file);
+
+    try {
+      const response = await fetch("https://localhost:3000/users/avatar", {
+        method: "POST",
+        credentials: "include",
+        body: formData,
+      });
+      const data = await response.json();
+      if (!response.ok) {
+        throw new Error(data.message || "Failed to upload avatar");
+      }
+      setUpdatedUser((prev) => ({ ...prev, ImgPath: data.user.ImgPath }));
+      setUserUpdated((prev) => !prev);
+    } catch (error) {
+      Swal.fire("Error", error.message, "error");
+    }
   };
 
   return (
@@ -189,10 +202,12 @@ const EditUser = () => {
           </div>
         )}
         <div className="form-group">
-          <label>
-            Upload Image:
-            <input type="file" accept="image/*" onChange={handleImageUpload} />
-          </label>
+          {!name && (
+            <label>
+              Upload Image:
+              <input type="file" accept="image/jpeg,image/png,image/gif" onChange={handleImageUpload} />
+            </label>
+          )}
           {updatedUser.ImgPath && (
             <div className="image-preview">
               <img
@@ -8,7 +8,7 @@ function Friends() {
   const [searchTerm, setSearchTerm] = useState('');
   const [newFriend, setNewFriend] = useState('');
   const [filteredFriends, setFilteredFriends] = useState([]);
-  const { isLoggedIn, loading } = useContext(AuthContext);
+  const { isLoggedIn, loading, notifications } = useContext(AuthContext);
 
   useEffect(() => {
     if (!friends) return;
@@ -18,21 +18,27 @@ function Friends() {
     setFilteredFriends(filtered);
   }, [searchTerm, friends]);
 
+  // Friend notifications mean the list changed on the other side
   useEffect(() => {
     if (!loading && isLoggedIn) {
       fetchFriends();
     }
-  }, [isLoggedIn, loading]);
+  }, [isLoggedIn, loading, notifications]);
 
   const fetchFriends = async () => {
     try {
-      const res = await fetch('https://localhost:3000/friends/all', {
-        credentials: 'include',
-      });
-      const data = await res.json();
-      setFriends(data.friends);
-      
-      console.log('Fetched friends:', data.friends);
+      // The list is paged, the search box filters all of it so load every page
+      let all = [];
+      let cursor = '';
+      do {
+        const res = await fetch(`https://localhost:3000/friends/all?limit=100&cursor=${encodeURIComponent(cursor)}`, {
+          credentials: 'include',
+        });
+        const data = await res.json();
+        all = all.concat(data.friends);
+        cursor = data.nextCursor;
+      } while (cursor);
+      setFriends(all);
     } catch (err) {
       console.error('Error fetching friends:', err);
       Swal.fire('Error', 'Failed to fetch friends.', 'error');
@@ -103,6 +109,28 @@ function Friends() {
     }
   }
 
+  // Decline, cancel and block all post the other user's name
+  const friendAction = async (path, name, doneTitle, doneText) => {
+    try {
+      const res = await fetch(`https://localhost:3000${path}`, {
+        method: 'POST',
+        credentials: 'include',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name: name }),
+      });
+      if (res.ok) {
+        fetchFriends();
+        Swal.fire(doneTitle, doneText, 'success');
+      } else {
+        const errData = await res.json();
+        Swal.fire('Error', errData.message || 'Request failed.', 'error');
+      }
+    } catch (err) {
+      console.error(`Error calling ${path}:`, err);
+      Swal.fire('Error', 'Something went wrong.', 'error');
+    }
+  };
+
   return (
     <div className="card">
       <h2>Your Friends</h2>
@@ -127,16 +155,28 @@ function Friends() {
         {filteredFriends.map((friend) => (
           <li key={friend.user.ID}>
             <span>{friend.user.Name}</span>
+            {friend.mutualFriends > 0 && (
+              <span className="mutual"> · {friend.mutualFriends} mutual</span>
+            )}
+            {friend.lastMet && (
+              <span className="last-met"> · last met in {friend.lastMet.session} on {new Date(friend.lastMet.at).toLocaleDateString()}</span>
+            )}
             {friend.accepted ? (
               <span className="accepted"> (Accepted)</span>
             ) : (<>
               <span className="pending"> (Pending)</span>
-              {friend.thisUserNeedToAccept && (
+              {friend.thisUserNeedToAccept ? (<>
                 <button onClick={() => acceptFriend(friend.user.Name)}>accept</button>
+                <button onClick={() => friendAction('/friends/decline', friend.user.Name, 'Declined', 'Friend request declined.')}>decline</button>
+              </>) : (
+                <button onClick={() => friendAction('/friends/cancel', friend.user.Name, 'Cancelled', 'Friend request cancelled.')}>cancel</button>
               )}
               </>
             )}
-            <button onClick={() => deleteFriend(friend.user.Name)}>Remove</button>
+            {friend.accepted && (
+              <button onClick={() => deleteFriend(friend.user.Name)}>Remove</button>
+            )}
+            <button onClick={() => friendAction('/users/blocks', friend.user.Name, 'Blocked', 'User blocked.')}>Block</button>
           </li>
         ))}
       </ul>
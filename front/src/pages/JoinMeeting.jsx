@@ -9,8 +9,11 @@ const JoinMeeting = () => {
   const [sessionId, setSessionId] = useState("");
   const [error, setError] = useState(null);
   const navigate = useNavigate();
-  const { isLoggedIn, logout, loading } = useContext(AuthContext);
+  const { isLoggedIn, logout, loading, waitingRoomEvent } = useContext(AuthContext);
   const [user, setUser] = useState(null);
+  const [passcode, setPasscode] = useState('');
+  const [needsPasscode, setNeedsPasscode] = useState(false);
+  const [waitingFor, setWaitingFor] = useState(null); // Session ID while in its waiting room
 
   useEffect(() => {
     const fetchUser = async () => {
@@ -50,6 +53,38 @@ const JoinMeeting = () => {
     }
   }, [isLoggedIn, loading, navigate, logout]);
 
+  // The host answered while we were in the waiting room
+  useEffect(() => {
+    if (!waitingRoomEvent || waitingRoomEvent.sessionId !== waitingFor) return;
+    setWaitingFor(null);
+    Swal.close();
+    if (waitingRoomEvent.type === 'waiting_room_admitted') {
+      navigate(`/m/${waitingRoomEvent.session}`);
+    } else {
+      setError(waitingRoomEvent.type === 'waiting_room_rejected'
+        ? 'The host did not let you in.'
+        : 'The meeting has ended.');
+    }
+  }, [waitingRoomEvent, waitingFor, navigate]);
+
+  const waitForHost = (id) => {
+    setWaitingFor(id);
+    Swal.fire({
+      title: 'Waiting room',
+      text: 'Please wait, the host will let you in soon.',
+      showConfirmButton: false,
+      showCancelButton: true,
+      cancelButtonText: 'Leave',
+      allowOutsideClick: false,
+      didOpen: () => Swal.showLoading(),
+    }).then((result) => {
+      if (result.dismiss !== Swal.DismissReason.cancel) return;
+      setWaitingFor(null);
+      fetch(`https://localhost:3000/sessions/${sessionId}/waiting`, { method: 'DELETE', credentials: 'include' })
+        .catch((err) => console.error('Error leaving waiting room:', err));
+    });
+  };
+
   const pasteFromClipboard = async () => {
     try {
       const text = await navigator.clipboard.readText();
@@ -74,11 +109,18 @@ const JoinMeeting = () => {
           'Content-Type': 'application/json',
         },
         credentials: 'include',
-        body: JSON.stringify({ name: sessionId }),
+        body: JSON.stringify({ name: sessionId, passcode }),
       });
 
+      const data = await response.json();
       if (!response.ok) {
-        throw new Error(`Failed to join session: ${response.statusText}`);
+        if (data.passcodeRequired) setNeedsPasscode(true);
+        throw new Error(data.error || `Failed to join session: ${response.statusText}`);
+      }
+      if (data.waiting) {
+        setError(null);
+        waitForHost(data.session_id);
+        return;
       }
 
       Swal.fire({
@@ -129,6 +171,19 @@ const JoinMeeting = () => {
           </div>
         </div>
 
+        {needsPasscode && (
+          <div className="form-group">
+            <label htmlFor="passcode">Passcode:</label>
+            <input
+              type="password"
+              id="passcode"
+              value={passcode}
+              onChange={(e) => setPasscode(e.target.value)}
+              className="room-input"
+            />
+          </div>
+        )}
+
         {error && <p className="error">{error}</p>}
 
         <button type="submit" className="btn">Join Room</button>
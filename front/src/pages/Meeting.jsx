@@ -17,7 +17,22 @@ const Meeting = () => {
   const [userID, setUserID] = useState();
   const navigate = useNavigate();
 
+  const [moderator, setModerator] = useState(false);
+  const [waiting, setWaiting] = useState([]);
+  const [locked, setLocked] = useState(false);
+  const wsRef = useRef(null);
+
   const initializedParticipants = useRef(new Set());
+  const localStreamRef = useRef(null);
+  // Camera and microphone defaults from the user's preferences, sent by the server on connect
+  const joinStateRef = useRef({ cameraOn: true, microphoneOn: true });
+
+  const applyJoinState = () => {
+    const stream = localStreamRef.current;
+    if (!stream) return;
+    stream.getVideoTracks().forEach((track) => { track.enabled = joinStateRef.current.cameraOn; });
+    stream.getAudioTracks().forEach((track) => { track.enabled = joinStateRef.current.microphoneOn; });
+  };
 
   const startFaceDetection = (videoElement, canvas) => {
     const displaySize = { width: videoElement.videoWidth, height: videoElement.videoHeight };
@@ -36,7 +51,7 @@ const Meeting = () => {
     return interval;
   };
 
-  const startMedia = async (userId) => {
+  const startMedia = async () => {
     let mediaRecorder;
     let socket;
     let stream;
@@ -44,6 +59,8 @@ const Meeting = () => {
     try {
       stream = await navigator.mediaDevices.getUserMedia({ video: true, audio: true });
       localVideoRef.current.srcObject = stream;
+      localStreamRef.current = stream;
+      applyJoinState();
 
       // Wait for video to load metadata before starting face detection
       localVideoRef.current.onloadedmetadata = () => {
@@ -51,7 +68,16 @@ const Meeting = () => {
         startFaceDetection(localVideoRef.current, canvas);
       };
 
-      socket = new WebSocket(`wss://localhost:8080/b?userID=${userId}`);
+      // The media socket only accepts a short-lived token for our current session
+      const tokenRes = await fetch('https://localhost:3000/sessions/ingest-token', {
+        method: 'POST',
+        credentials: 'include',
+      });
+      if (!tokenRes.ok) {
+        throw new Error('Could not get an ingest token');
+      }
+      const { token } = await tokenRes.json();
+      socket = new WebSocket(`wss://localhost:8080/b?token=${encodeURIComponent(token)}`);
 
       socket.onopen = () => {
         console.log('WebSocket connected!');
@@ -86,13 +112,13 @@ const Meeting = () => {
     const data = await res.json();
     setName(data.user.Name);
     setUserID(data.user.ID);
-    startMedia(data.user.ID);
+    startMedia();
   };
 
   async function waitForMPD(streamURL, maxRetries = 10, delay = 1000) {
     for (let i = 0; i < maxRetries; i++) {
       try {
-        const res = await fetch(streamURL, { method: 'HEAD' });
+        const res = await fetch(streamURL, { method: 'HEAD', credentials: 'include' });
         if (res.ok) return true;
       } catch (_) {}
       await new Promise(res => setTimeout(res, delay));
@@ -108,6 +134,8 @@ const Meeting = () => {
     }
     const data = await res.json();
     setParticipants(data.participants);
+    setModerator(data.moderator);
+    setLocked(data.locked);
   
     data.participants.forEach(async (p) => {
       if (p.streamURL && !initializedParticipants.current.has(p.id)) {
@@ -131,6 +159,11 @@ const Meeting = () => {
               }
             });
   
+            // Session media needs the auth cookie
+            player.addRequestInterceptor((request) => {
+              request.credentials = 'include';
+              return Promise.resolve(request);
+            });
             player.initialize(videoElement, p.streamURL, true);
             initializedParticipants.current.add(p.id);
             // player.on('error', (e) => {
@@ -178,12 +211,76 @@ const Meeting = () => {
     }
   }, [id, isLoggedIn]);
 
+  // Moderators load who is already waiting, later changes arrive over the websocket
+  useEffect(() => {
+    if (!moderator) return;
+    fetch(`https://localhost:3000/sessions/${id}/waiting`, { credentials: 'include' })
+      .then((res) => (res.ok ? res.json() : { waiting: [] }))
+      .then((data) => setWaiting(data.waiting))
+      .catch((err) => console.error('Error fetching waiting room:', err));
+  }, [moderator, id]);
+
+  // Moderation commands go over the meeting websocket, errors come back as 'error' messages
+  const sendCommand = (command) => {
+    if (wsRef.current?.readyState === WebSocket.OPEN) {
+      wsRef.current.send(JSON.stringify(command));
+    }
+  };
+
+  const removeParticipant = async (participantName) => {
+    const result = await Swal.fire({
+      title: `Remove ${participantName}?`,
+      input: 'checkbox',
+      inputPlaceholder: 'Do not let them join again',
+      showCancelButton: true,
+      confirmButtonText: 'Remove',
+    });
+    if (result.isConfirmed) sendCommand({ type: 'remove', name: participantName, ban: result.value === 1 });
+  };
+
+  const endForAll = async () => {
+    const result = await Swal.fire({
+      title: 'End the meeting for everyone?',
+      showCancelButton: true,
+      confirmButtonText: 'End meeting',
+    });
+    if (result.isConfirmed) sendCommand({ type: 'end' });
+  };
+
   // 4. WebSocket listener for participant updates (once on mount)
   useEffect(() => {
     const ws = new WebSocket(`wss://localhost:3000/ws`);
+    wsRef.current = ws;
     ws.onopen = () => console.log('WebSocket connected!');
     ws.onmessage = (event) => {
       const message = event.data;
+      if (message.startsWith('{')) {
+        const data = JSON.parse(message);
+        if (data.type === 'initial_state') {
+          joinStateRef.current = { cameraOn: data.cameraOn, microphoneOn: data.microphoneOn };
+          applyJoinState();
+        } else if (data.type === 'waiting_room') {
+          setWaiting(data.waiting);
+        } else if (data.type === 'mute' || data.type === 'video_off') {
+          // A moderator turned our microphone or camera off, only we can turn it back on
+          const stream = localStreamRef.current;
+          const tracks = data.type === 'mute' ? stream?.getAudioTracks() : stream?.getVideoTracks();
+          tracks?.forEach((track) => { track.enabled = false; });
+          Swal.fire({ icon: 'info', title: data.type === 'mute' ? 'You were muted' : 'Your camera was turned off', timer: 3000 });
+        } else if (data.type === 'removed' || data.type === 'session_ended') {
+          localStreamRef.current?.getTracks().forEach((track) => track.stop());
+          Swal.fire({
+            icon: 'info',
+            title: data.type === 'removed' ? 'You were removed from the meeting' : 'The meeting has ended',
+          });
+          navigate('/home');
+        } else if (data.type === 'locked') {
+          setLocked(data.locked);
+        } else if (data.type === 'error') {
+          Swal.fire({ icon: 'error', title: 'Meeting', text: data.message });
+        }
+        return;
+      }
       if (message.includes('has joined') || message.includes('has left') || message.includes('stream started')) {
         fetchParticipants();
       }
@@ -197,8 +294,29 @@ const Meeting = () => {
       <div className="top-bar">
         <h2>Meeting ID: {id}</h2>
         <h3>Welcome, {name}</h3>
+        {moderator && (
+          <div className="moderator-controls">
+            <button onClick={() => sendCommand({ type: 'lock', locked: !locked })}>
+              {locked ? 'Unlock meeting' : 'Lock meeting'}
+            </button>
+            <button className="end-button" onClick={endForAll}>End for all</button>
+          </div>
+        )}
       </div>
 
+      {moderator && waiting.length > 0 && (
+        <div className="waiting-room">
+          <h4>Waiting room</h4>
+          {waiting.map((w) => (
+            <div key={w.user.ID} className="waiting-user">
+              <span>{w.user.DisplayName || w.user.Name}</span>
+              <button onClick={() => sendCommand({ type: 'admit', name: w.user.Name })}>Admit</button>
+              <button onClick={() => sendCommand({ type: 'reject', name: w.user.Name })}>Reject</button>
+            </div>
+          ))}
+        </div>
+      )}
+
       <div className="videos-container">
         {/* Local Video */}
         <div className="video-card">
@@ -230,6 +348,13 @@ const Meeting = () => {
             ) : (
               <p className="live-indicator">Live</p>
             )}
+            {moderator && p.role !== 'host' && (
+              <div className="moderator-controls">
+                <button onClick={() => sendCommand({ type: 'mute', name: p.name })}>Mute</button>
+                <button onClick={() => sendCommand({ type: 'video_off', name: p.name })}>Stop video</button>
+                <button onClick={() => removeParticipant(p.name)}>Remove</button>
+              </div>
+            )}
           </div>
         ))}
       </div>
@@ -2,7 +2,6 @@ import React, { useState, useEffect } from 'react';
 import './Signup.css';
 import { useNavigate, Link } from 'react-router-dom';
 import Swal from 'sweetalert2';
-import Profile from '../assets/deafultProfile.avif'
 
 const SignUp = () => {
   const [name, setName] = useState('');
@@ -35,7 +34,7 @@ const SignUp = () => {
       const response = await fetch('https://localhost:3000/users/signup', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ name, password, ImgPath: Profile}),
+        body: JSON.stringify({ name, password }),
       });
 
       if (!response.ok) {